@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Handshakes are timed from dialing until the key exchange is done. Round
+// trips are timed from writing a message until its echo has been read, each
+// on a new session since the echo server answers one message per session.
+// Throughput is measured by streaming many messages over one session, which
+// needs a server that echoes every message, such as serve -mode stream-echo.
+// Against a plain echo server it's reported as unavailable.
+
+// benchResult holds the results of a benchmark run.
+type benchResult struct {
+	Server     string          `json:"server"`
+	Handshakes benchHandshakes `json:"handshakes"`
+	Sizes      []benchSize     `json:"sizes"`
+}
+
+type benchHandshakes struct {
+	Count     int     `json:"count"`
+	PerSecond float64 `json:"per_second"`
+}
+
+// benchSize holds the round trip times and throughput for messages of one
+// size. Throughput counts the bytes sent, not their echo. If it couldn't be
+// measured, ThroughputError says why.
+type benchSize struct {
+	Size            int           `json:"size"`
+	Count           int           `json:"count"`
+	P50             time.Duration `json:"p50_ns"`
+	P90             time.Duration `json:"p90_ns"`
+	P99             time.Duration `json:"p99_ns"`
+	Max             time.Duration `json:"max_ns"`
+	BytesPerSecond  float64       `json:"bytes_per_second,omitempty"`
+	ThroughputError string        `json:"throughput_error,omitempty"`
+}
+
+// runBench measures n handshakes with the echo server at addr, then for
+// each message size, n round trips and the time to stream n messages.
+func runBench(ctx context.Context, network, addr string, n int, sizes []int, opts ...DialOption) (*benchResult, error) {
+	res := &benchResult{Server: addr}
+
+	var total time.Duration
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		conn, err := DialContext(ctx, network, addr, opts...)
+		if err != nil {
+			return nil, err
+		}
+		total += time.Since(start)
+		conn.Close()
+	}
+	res.Handshakes = benchHandshakes{Count: n, PerSecond: float64(n) / total.Seconds()}
+
+	for _, size := range sizes {
+		s, err := benchRoundTrips(ctx, network, addr, n, size, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("%d byte messages: %s", size, err)
+		}
+		s.BytesPerSecond, err = benchThroughput(ctx, network, addr, n, size, opts...)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			s.ThroughputError = err.Error()
+		}
+		res.Sizes = append(res.Sizes, *s)
+	}
+	return res, nil
+}
+
+func benchRoundTrips(ctx context.Context, network, addr string, n, size int, opts ...DialOption) (*benchSize, error) {
+	msg := make([]byte, size)
+	if _, err := rand.Read(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	times := make([]time.Duration, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := DialContext(ctx, network, addr, opts...)
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		_, err = conn.Write(msg)
+		if err == nil {
+			_, err = io.ReadFull(conn, buf)
+		}
+		d := time.Since(start)
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(buf, msg) {
+			return nil, errors.New("the echo didn't match the message")
+		}
+		times = append(times, d)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return &benchSize{
+		Size:  size,
+		Count: n,
+		P50:   percentile(times, 0.50),
+		P90:   percentile(times, 0.90),
+		P99:   percentile(times, 0.99),
+		Max:   times[len(times)-1],
+	}, nil
+}
+
+// benchThroughput streams n messages of size bytes over one session while
+// reading their echoes, and returns the bytes sent per second.
+func benchThroughput(ctx context.Context, network, addr string, n, size int, opts ...DialOption) (float64, error) {
+	conn, err := DialContext(ctx, network, addr, opts...)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	msg := make([]byte, size)
+
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			if _, err := conn.Write(msg); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- closeWrite(conn)
+	}()
+	got, err := io.Copy(io.Discard, conn)
+	elapsed := time.Since(start)
+	want := int64(n * size)
+	if err == nil && got != want {
+		err = fmt.Errorf("got %d bytes back, want %d", got, want)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s; the server must echo every message, as serve -mode stream-echo does", err)
+	}
+	if err := <-errc; err != nil {
+		return 0, err
+	}
+	return float64(want) / elapsed.Seconds(), nil
+}
+
+// percentile returns the p'th percentile of the sorted times.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// writeBench writes res to w as a table, or as JSON if asJSON is set.
+func writeBench(w io.Writer, res *benchResult, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	fmt.Fprintf(w, "server %s\n", res.Server)
+	fmt.Fprintf(w, "handshakes %d, %.1f/s\n\n", res.Handshakes.Count, res.Handshakes.PerSecond)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "size\tcount\tp50\tp90\tp99\tmax\tthroughput\t")
+	var unavailable string
+	for _, s := range res.Sizes {
+		throughput := fmt.Sprintf("%.2f MB/s", s.BytesPerSecond/1e6)
+		if s.ThroughputError != "" {
+			throughput = "n/a"
+			unavailable = s.ThroughputError
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\t%s\t%s\t\n", s.Size, s.Count, roundDuration(s.P50), roundDuration(s.P90), roundDuration(s.P99), roundDuration(s.Max), throughput)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if unavailable != "" {
+		fmt.Fprintf(w, "\nthroughput not measured: %s\n", unavailable)
+	}
+	return nil
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
+
+// parseSizes parses a comma separated list of message sizes.
+func parseSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, f := range strings.Split(s, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || size < 1 || uint64(size) > maxMessageSize {
+			return nil, fmt.Errorf("bad size %q, want 1 to %d", f, maxMessageSize)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+func benchCommand(args []string, logger *slog.Logger) error {
+	fs := newFlagSet("bench", "[flags] [<[host:]port>]")
+	n := fs.Int("n", 200, "Number of handshakes, and of round trips and streamed messages for each size")
+	sizeList := fs.String("sizes", "64,1024,16384,32768", "Comma separated message sizes in bytes")
+	asJSON := fs.Bool("json", false, "Print the results as JSON")
+	dialOpts := clientFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: bench [flags] [<[host:]port>]\n\nMeasures an echo server, or one started in this process if none is given.\nThroughput needs a server that echoes every message, as serve -mode\nstream-echo does.\n")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return usageError(fs, "bench takes at most one server")
+	}
+	if *n < 1 {
+		return usageError(fs, "-n must be at least 1")
+	}
+	sizes, err := parseSizes(*sizeList)
+	if err != nil {
+		return usageError(fs, err.Error())
+	}
+	opts, err := dialOpts()
+	if err != nil {
+		return err
+	}
+
+	var addr string
+	if fs.NArg() == 1 {
+		addr = hostPort(fs.Arg(0), "localhost")
+	} else {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		// The server isn't given the logger, since closing the listener
+		// makes it log an error.
+		s := NewServer(NewKeyPair())
+		s.Handler = StreamEchoHandler
+		go s.Serve(l)
+		addr = l.Addr().String()
+		opts = append(opts, WithServerKey(s.keyPair.pub))
+	}
+
+	res, err := runBench(context.Background(), "tcp", addr, *n, sizes, append(opts, WithLogger(logger))...)
+	if err != nil {
+		return err
+	}
+	return writeBench(os.Stdout, res, *asJSON)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_runBench(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = StreamEchoHandler
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	sizes := []int{1, int(maxMessageSize)}
+	res, err := runBench(context.Background(), "tcp", addr, 5, sizes, WithServerKey(s.keyPair.pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Handshakes.Count != 5 || res.Handshakes.PerSecond <= 0 {
+		t.Errorf("Got handshakes %+v", res.Handshakes)
+	}
+	if len(res.Sizes) != len(sizes) {
+		t.Fatalf("Got %d sizes, want %d", len(res.Sizes), len(sizes))
+	}
+	for i, r := range res.Sizes {
+		if r.Size != sizes[i] || r.Count != 5 {
+			t.Errorf("Got size %d count %d, want %d and 5", r.Size, r.Count, sizes[i])
+		}
+		if r.P50 <= 0 || r.P50 > r.P90 || r.P90 > r.P99 || r.P99 > r.Max {
+			t.Errorf("Got percentiles out of order: %+v", r)
+		}
+		if r.BytesPerSecond <= 0 {
+			t.Errorf("Got throughput %f", r.BytesPerSecond)
+		}
+	}
+}
+
+func Test_runBench_EchoHandler(t *testing.T) {
+	// EchoHandler answers one message per session, so throughput can't be
+	// measured, but everything else can.
+	s := NewServer(NewKeyPair())
+	s.Handler = EchoHandler
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	res, err := runBench(context.Background(), "tcp", addr, 3, []int{64, 1024}, WithServerKey(s.keyPair.pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Handshakes.Count != 3 || res.Handshakes.PerSecond <= 0 {
+		t.Errorf("Got handshakes %+v", res.Handshakes)
+	}
+	if len(res.Sizes) != 2 {
+		t.Fatalf("Got %d sizes, want 2", len(res.Sizes))
+	}
+	for _, r := range res.Sizes {
+		if r.P50 <= 0 || r.Max < r.P50 {
+			t.Errorf("Got round trips %+v", r)
+		}
+		if r.BytesPerSecond != 0 || !strings.Contains(r.ThroughputError, "stream-echo") {
+			t.Errorf("Got throughput %f %q, want it unavailable", r.BytesPerSecond, r.ThroughputError)
+		}
+	}
+
+	var table bytes.Buffer
+	if err := writeBench(&table, res, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"n/a", "throughput not measured"} {
+		if !strings.Contains(table.String(), want) {
+			t.Errorf("Want %q in\n%s", want, table.String())
+		}
+	}
+}
+
+func Test_percentile(t *testing.T) {
+	var times []time.Duration
+	for i := 1; i <= 100; i++ {
+		times = append(times, time.Duration(i))
+	}
+	for _, test := range []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, 1},
+		{0.5, 50},
+		{0.99, 99},
+		{1, 100},
+	} {
+		if got := percentile(times, test.p); got != test.want {
+			t.Errorf("p%v: got %d, want %d", test.p, got, test.want)
+		}
+	}
+	if got := percentile(times[:1], 0.99); got != 1 {
+		t.Errorf("Got %d, want 1", got)
+	}
+}
+
+func Test_parseSizes(t *testing.T) {
+	sizes, err := parseSizes("64, 1024,32768")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 3 || sizes[0] != 64 || sizes[1] != 1024 || sizes[2] != 32768 {
+		t.Errorf("Got %v", sizes)
+	}
+	for _, s := range []string{"", "0", "64,x", "32769"} {
+		if _, err := parseSizes(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func Test_writeBench(t *testing.T) {
+	res := &benchResult{
+		Server:     "localhost:7000",
+		Handshakes: benchHandshakes{Count: 10, PerSecond: 500},
+		Sizes: []benchSize{
+			{Size: 64, Count: 10, P50: time.Millisecond, P90: 2 * time.Millisecond, P99: 3 * time.Millisecond, Max: 4 * time.Millisecond, BytesPerSecond: 1.5e6},
+		},
+	}
+
+	var table bytes.Buffer
+	if err := writeBench(&table, res, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"handshakes 10, 500.0/s", "p50", "1ms", "1.50 MB/s"} {
+		if !strings.Contains(table.String(), want) {
+			t.Errorf("Want %q in\n%s", want, table.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if err := writeBench(&out, res, true); err != nil {
+		t.Fatal(err)
+	}
+	var got benchResult
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Sizes[0].P99 != 3*time.Millisecond || got.Handshakes.PerSecond != 500 {
+		t.Errorf("Got %+v", got)
+	}
+}
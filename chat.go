@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// chatQueueSize is how many lines may be waiting for a member before
+	// they're disconnected for being too slow.
+	chatQueueSize = 64
+
+	maxNickLength = 32
+)
+
+// ChatRoom is a Handler that relays lines of text between all connected
+// clients. Each member is known by their public key's fingerprint, until
+// they choose a nickname with /nick. A nickname stays bound to the key that
+// chose it, so nobody else can take it while the server runs. /who lists the
+// members.
+type ChatRoom struct {
+	// Logger, if set, receives a message as members join and leave.
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	members map[*chatMember]bool
+	nicks   map[string][keySize]byte
+	names   map[[keySize]byte]string
+}
+
+type chatMember struct {
+	peer   [keySize]byte
+	conn   *Conn
+	out    chan string
+	done   chan struct{}
+	kicked bool
+}
+
+// ServeSession implements Handler.
+func (r *ChatRoom) ServeSession(c *Conn) error {
+	m := &chatMember{
+		peer: c.Session().Peer,
+		conn: c,
+		out:  make(chan string, chatQueueSize),
+		done: make(chan struct{}),
+	}
+	go m.writeLoop()
+	r.join(m)
+
+	s := bufio.NewScanner(c)
+	for s.Scan() {
+		r.handleLine(m, strings.TrimSpace(s.Text()))
+	}
+	r.leave(m)
+	<-m.done
+	return s.Err()
+}
+
+func (m *chatMember) writeLoop() {
+	defer close(m.done)
+	for line := range m.out {
+		if _, err := io.WriteString(m.conn, line+"\n"); err != nil {
+			m.conn.Close()
+			for range m.out {
+			}
+			return
+		}
+	}
+}
+
+func (r *ChatRoom) join(m *chatMember) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.members == nil {
+		r.members = make(map[*chatMember]bool)
+		r.nicks = make(map[string][keySize]byte)
+		r.names = make(map[[keySize]byte]string)
+	}
+	r.members[m] = true
+	name := r.name(m)
+	orDiscard(r.Logger).Info("chat member joined", "name", name)
+	r.broadcast(m, "* "+name+" joined")
+}
+
+func (r *ChatRoom) leave(m *chatMember) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.members, m)
+	close(m.out)
+	name := r.name(m)
+	orDiscard(r.Logger).Info("chat member left", "name", name)
+	r.broadcast(m, "* "+name+" left")
+}
+
+func (r *ChatRoom) handleLine(m *chatMember, line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case line == "":
+	case strings.HasPrefix(line, "/nick "):
+		r.setNick(m, strings.TrimSpace(strings.TrimPrefix(line, "/nick ")))
+	case line == "/who":
+		var names []string
+		for o := range r.members {
+			names = append(names, r.name(o))
+		}
+		sort.Strings(names)
+		r.send(m, "* members: "+strings.Join(names, ", "))
+	case strings.HasPrefix(line, "/"):
+		r.send(m, "* unknown command; try /nick or /who")
+	default:
+		r.broadcast(m, r.name(m)+": "+line)
+	}
+}
+
+// setNick binds nick to m's key. Must be called with mu held.
+func (r *ChatRoom) setNick(m *chatMember, nick string) {
+	if nick == "" || len(nick) > maxNickLength || strings.ContainsAny(nick, " \t:*/") {
+		r.send(m, fmt.Sprintf("* a nickname needs 1-%d characters, without spaces or :*/", maxNickLength))
+		return
+	}
+	if owner, ok := r.nicks[nick]; ok && owner != m.peer {
+		r.send(m, "* "+nick+" belongs to someone else")
+		return
+	}
+	old := r.name(m)
+	delete(r.nicks, r.names[m.peer])
+	r.nicks[nick] = m.peer
+	r.names[m.peer] = nick
+	r.send(m, "* you are now "+nick)
+	r.broadcast(m, "* "+old+" is now "+nick)
+}
+
+// name returns what m is called. Must be called with mu held.
+func (r *ChatRoom) name(m *chatMember) string {
+	if name, ok := r.names[m.peer]; ok {
+		return name
+	}
+	return Fingerprint(&m.peer)
+}
+
+// broadcast sends line to every member but from. Must be called with mu
+// held.
+func (r *ChatRoom) broadcast(from *chatMember, line string) {
+	for m := range r.members {
+		if m != from {
+			r.send(m, line)
+		}
+	}
+}
+
+// send queues line for m, disconnecting m if they've fallen too far behind.
+// Must be called with mu held.
+func (r *ChatRoom) send(m *chatMember, line string) {
+	if m.kicked || !r.members[m] {
+		return
+	}
+	select {
+	case m.out <- line:
+	default:
+		orDiscard(r.Logger).Warn("disconnecting slow chat member", "name", r.name(m))
+		m.kicked = true
+		m.conn.Close()
+	}
+}
+
+// chat sends each line of in to conn as a message, and copies what the
+// server sends to out, until in is exhausted or the server hangs up.
+func chat(conn io.ReadWriter, in io.Reader, out io.Writer) error {
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(out, conn)
+		errc <- err
+	}()
+	s := bufio.NewScanner(in)
+	for s.Scan() {
+		if _, err := io.WriteString(conn, s.Text()+"\n"); err != nil {
+			return err
+		}
+		select {
+		case err := <-errc:
+			return err
+		default:
+		}
+	}
+	return s.Err()
+}
+
+// chatCommand runs the chat command with args.
+func chatCommand(args []string, in io.Reader, out io.Writer, logger *slog.Logger) error {
+	fs := newFlagSet("chat", "[flags] <[host:]port>")
+	dialOpts := clientFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "chat needs a server")
+	}
+	opts, err := dialOpts()
+	if err != nil {
+		return err
+	}
+	conn, err := DialContext(context.Background(), "tcp", hostPort(fs.Arg(0), "localhost"), append(opts, WithLogger(logger))...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return chat(conn, in, out)
+}
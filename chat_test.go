@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+type chatClient struct {
+	t    *testing.T
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	name string
+}
+
+func newChatClient(t *testing.T, addr string) *chatClient {
+	kp := NewKeyPair()
+	conn, err := Dial(addr, WithKeyPair(kp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &chatClient{t: t, conn: conn, r: bufio.NewReader(conn), name: Fingerprint(kp.pub)}
+}
+
+func (c *chatClient) say(line string) {
+	if _, err := io.WriteString(c.conn, line+"\n"); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *chatClient) expect(want string) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("Want %q, got error %v", want, err)
+	}
+	if got := strings.TrimSuffix(line, "\n"); got != want {
+		c.t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func Test_ChatRoom(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = &ChatRoom{}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	alice := newChatClient(t, addr)
+	defer alice.conn.Close()
+	alice.say("/who")
+	alice.expect("* members: " + alice.name)
+	bob := newChatClient(t, addr)
+	defer bob.conn.Close()
+	alice.expect("* " + bob.name + " joined")
+
+	alice.say("/nick alice")
+	alice.expect("* you are now alice")
+	bob.expect("* " + alice.name + " is now alice")
+
+	alice.say("hello")
+	bob.expect("alice: hello")
+
+	// Bob can't take Alice's name.
+	bob.say("/nick alice")
+	bob.expect("* alice belongs to someone else")
+	bob.say("/nick bad name")
+	bob.expect("* a nickname needs 1-32 characters, without spaces or :*/")
+
+	bob.say("/who")
+	want := []string{"alice", bob.name}
+	if bob.name < "alice" {
+		want = []string{bob.name, "alice"}
+	}
+	bob.expect("* members: " + strings.Join(want, ", "))
+
+	bob.conn.Close()
+	alice.expect("* " + bob.name + " left")
+}
+
+func Test_chat(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = &ChatRoom{}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	listener := newChatClient(t, addr)
+	defer listener.conn.Close()
+	listener.say("/who")
+	listener.expect("* members: " + listener.name)
+
+	conn, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	listener.r.ReadString('\n') // joined
+
+	if err := chat(conn, strings.NewReader("one\ntwo\n"), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	line, _ := listener.r.ReadString('\n')
+	if !strings.HasSuffix(line, ": one\n") {
+		t.Errorf("Got %q, want one", line)
+	}
+	line, _ = listener.r.ReadString('\n')
+	if !strings.HasSuffix(line, ": two\n") {
+		t.Errorf("Got %q, want two", line)
+	}
+}
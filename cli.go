@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// version is reported by the version command. Release builds set it with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// Exit codes shared by every command.
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// errUsage is returned by a command when its flags or arguments are wrong.
+// The problem has already been reported along with the command's usage.
+var errUsage = errors.New("bad usage")
+
+// exitCode is returned by a command that has nothing to report but wants to
+// exit with a particular code.
+type exitCode int
+
+func (c exitCode) Error() string {
+	return fmt.Sprintf("exit status %d", int(c))
+}
+
+// parseFlags parses a command's args with fs, returning flag.ErrHelp if help
+// was asked for, or errUsage if the flags are wrong.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+	return nil
+}
+
+// usageError reports msg along with the command's usage and returns
+// errUsage.
+func usageError(fs *flag.FlagSet, msg string) error {
+	fs.Usage()
+	fmt.Fprintln(fs.Output(), msg)
+	return errUsage
+}
+
+// newFlagSet returns a FlagSet for the named command, whose usage is the
+// synopsis followed by its flags.
+func newFlagSet(name, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s\n", name, synopsis)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// A command is one of the CLI's subcommands.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string, logger *slog.Logger) error
+}
+
+func commands(configLevel func(string) error) []command {
+	return []command{
+		{"serve", "Run a server", func(args []string, logger *slog.Logger) error {
+			return serveCommand(args, logger, configLevel)
+		}},
+		{"dial", "Send a message to an echo server and print the reply", dialCommand},
+		{"connect", "Pipe stdin and stdout through a connection to a server", connectCommand},
+		{"listen", "Pipe stdin and stdout through a connection from one client", listenCommand},
+		{"send", "Send a file to a receive server", sendCommand},
+		{"receive", "Receive files into a directory", receiveCommand},
+		{"chat", "Join a chat server", func(args []string, logger *slog.Logger) error {
+			return chatCommand(args, os.Stdin, os.Stdout, logger)
+		}},
+		{"forward", "Forward ports through a forward server", forwardCommand},
+		{"socks", "Run a SOCKS5 proxy through a forward server", socksCommand},
+		{"relay", "Connect to a peer through a relay server", relayCommand},
+		{"exec", "Run a command on an exec server", func(args []string, logger *slog.Logger) error {
+			code, err := execCommand(args, logger)
+			if err == nil && code != 0 {
+				err = exitCode(code)
+			}
+			return err
+		}},
+		{"keygen", "Create a key pair file", keygenCommand},
+		{"fingerprint", "Print the fingerprint of a key", fingerprintCommand},
+		{"encrypt", "Encrypt stdin for a peer", encryptCommand},
+		{"decrypt", "Decrypt stdin from a peer", decryptCommand},
+		{"bench", "Measure an echo server's handshakes, latency and throughput", benchCommand},
+		{"version", "Print the version", versionCommand},
+	}
+}
+
+// run runs the CLI with args, not including the program name, and returns
+// the exit code.
+func run(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	logLevel := fs.String("log-level", "warn", "Log level: error, warn, info, debug or unsafe-trace")
+	port := fs.Int("l", 0, "Serve on this port. Same as serve -listen :port")
+
+	var level slog.LevelVar
+	levelGiven := false
+	cmds := commands(func(s string) error {
+		// The config file can't change a level given on the command line.
+		if levelGiven {
+			return nil
+		}
+		l, err := ParseLevel(s)
+		if err != nil {
+			return err
+		}
+		level.Set(l)
+		return nil
+	})
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s [flags] <command> [flags] [args]\n\nCommands:\n", name)
+		for _, c := range cmds {
+			fmt.Fprintf(out, "  %-12s %s\n", c.name, c.summary)
+		}
+		fmt.Fprintf(out, "\nRun \"%s help <command>\" for a command's flags. Servers are given as\n", name)
+		fmt.Fprintf(out, "[host:]port, with localhost as the default host.\n\n")
+		fmt.Fprintf(out, "The exit status is %d on success, %d if the command fails and %d if its\n", exitOK, exitFailure, exitUsage)
+		fmt.Fprintf(out, "flags or arguments are wrong. Once its remote command runs, exec exits with\n")
+		fmt.Fprintf(out, "that command's status, so %d or %d from exec may come from the remote command.\n\nFlags:\n", exitFailure, exitUsage)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	l, err := ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		return exitUsage
+	}
+	level.Set(l)
+	overrideFlags(fs, map[string]func(){"log-level": func() { levelGiven = true }})
+	logger := slog.New(slog.NewTextHandler(os.Stderr, NewLogHandlerOptions(&level)))
+
+	args = fs.Args()
+	switch {
+	case *port != 0:
+		// The original challenge's server mode.
+		args = append([]string{"serve", "-listen", fmt.Sprintf(":%d", *port)}, args...)
+	case len(args) == 2 && isPort(args[0]):
+		// The original challenge's client mode.
+		args = append([]string{"dial"}, args...)
+	case len(args) == 0:
+		fs.Usage()
+		return exitUsage
+	}
+
+	if args[0] == "help" {
+		if len(args) == 1 {
+			fs.SetOutput(os.Stdout)
+			fs.Usage()
+			return exitOK
+		}
+		args = []string{args[1], "-h"}
+	}
+	for _, c := range cmds {
+		if c.name == args[0] {
+			return exitStatus(name+" "+c.name, c.run(args[1:], logger))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s: unknown command %q\n", name, args[0])
+	fs.Usage()
+	return exitUsage
+}
+
+// exitStatus reports err, if there's anything to say, and returns the exit
+// code for it.
+func exitStatus(name string, err error) int {
+	var code exitCode
+	switch {
+	case err == nil, err == flag.ErrHelp:
+		return exitOK
+	case err == errUsage:
+		return exitUsage
+	case errors.As(err, &code):
+		return int(code)
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+	return exitFailure
+}
+
+func isPort(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 16)
+	return err == nil
+}
+
+func serveCommand(args []string, logger *slog.Logger, configLevel func(string) error) error {
+	fs := newFlagSet("serve", "[flags]")
+	listenAddr := fs.String("listen", ":7000", "Address to listen on")
+	metricsAddr := fs.String("metrics", "", "Serve Prometheus metrics over HTTP on this address")
+	mode := fs.String("mode", "echo", "How to handle clients: echo, stream-echo, forward, chat, relay or exec")
+	var execSpecs stringList
+	fs.Var(&execSpecs, "exec", "In exec mode, let authorized clients run this command: name=command [args...]")
+	loadConfig := serverFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageError(fs, "serve takes no arguments")
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.Listen == "" {
+		cfg.Listen = *listenAddr
+	}
+	overrideFlags(fs, map[string]func(){
+		"listen":  func() { cfg.Listen = hostPort(*listenAddr, "") },
+		"metrics": func() { cfg.Metrics = *metricsAddr },
+		"mode":    func() { cfg.Mode = *mode },
+	})
+	if len(execSpecs) > 0 {
+		cfg.Exec = make(map[string][]string)
+		for _, spec := range execSpecs {
+			name, argv, err := parseExecSpec(spec)
+			if err != nil {
+				return usageError(fs, err.Error())
+			}
+			cfg.Exec[name] = argv
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.LogLevel != "" {
+		if err := configLevel(cfg.LogLevel); err != nil {
+			return err
+		}
+	}
+
+	s, err := cfg.NewServer(logger)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if cfg.Metrics != "" {
+		r := NewRegistry()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", r)
+		ml, err := net.Listen("tcp", cfg.Metrics)
+		if err != nil {
+			return err
+		}
+		defer ml.Close()
+		go http.Serve(ml, mux)
+		s.Metrics = r
+	}
+	logger.Info("listening", "addr", l.Addr(), "key", fmt.Sprintf("%x", s.keyPair.pub[:]))
+	return s.Serve(l)
+}
+
+func dialCommand(args []string, logger *slog.Logger) error {
+	fs := newFlagSet("dial", "[flags] <[host:]port> <message>")
+	dialOpts := clientFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return usageError(fs, "dial needs a server and a message")
+	}
+	opts, err := dialOpts()
+	if err != nil {
+		return err
+	}
+	conn, err := DialContext(context.Background(), "tcp", hostPort(fs.Arg(0), "localhost"), append(opts, WithLogger(logger))...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, fs.Arg(1)); err != nil {
+		return err
+	}
+	buf := make([]byte, maxMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", buf[:n])
+	return nil
+}
+
+func connectCommand(args []string, logger *slog.Logger) error {
+	fs := newFlagSet("connect", "[flags] <[host:]port>")
+	dialOpts := clientFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "connect needs a server")
+	}
+	opts, err := dialOpts()
+	if err != nil {
+		return err
+	}
+	return connect(context.Background(), hostPort(fs.Arg(0), "localhost"), os.Stdin, os.Stdout, append(opts, WithLogger(logger))...)
+}
+
+func listenCommand(args []string, logger *slog.Logger) error {
+	fs := newFlagSet("listen", "<[host:]port>")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "listen needs an address")
+	}
+	l, err := net.Listen("tcp", hostPort(fs.Arg(0), ""))
+	if err != nil {
+		return err
+	}
+	return listen(l, os.Stdin, os.Stdout, logger)
+}
+
+func keygenCommand(args []string, logger *slog.Logger) error {
+	fs := newFlagSet("keygen", "<file>")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: keygen <file>\n\nWrites a new private key to file and prints its public key.\n")
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "keygen needs a file")
+	}
+	kp := NewKeyPair()
+	if err := WriteKeyPair(fs.Arg(0), kp); err != nil {
+		return err
+	}
+	fmt.Printf("%x\n", kp.pub[:])
+	return nil
+}
+
+func fingerprintCommand(args []string, logger *slog.Logger) error {
+	fs := newFlagSet("fingerprint", "<public key | key file>")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: fingerprint <public key | key file>\n\nPrints the fingerprint of a hex encoded public key, or of the key in a file\nwritten by keygen.\n")
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "fingerprint needs a key")
+	}
+	pub, err := readPublicKey(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Println(Fingerprint(pub))
+	return nil
+}
+
+// readPublicKey parses s as a hex encoded public key, or reads the key pair
+// in the file named s.
+func readPublicKey(s string) (*[keySize]byte, error) {
+	if pub, err := ParseKey(s); err == nil {
+		return pub, nil
+	}
+	kp, err := ReadKeyPair(s)
+	if err != nil {
+		return nil, err
+	}
+	return kp.pub, nil
+}
+
+// cryptFlags adds the flags shared by encrypt and decrypt to fs. The returned
+// function gives the key pair and the peer's public key once fs has been
+// parsed.
+func cryptFlags(fs *flag.FlagSet) func() (*KeyPair, *[keySize]byte, error) {
+	keyPath := fs.String("key", "", "File holding your private key")
+	peerKey := fs.String("peer", "", "The peer's public key, in hex or as a key file")
+	return func() (*KeyPair, *[keySize]byte, error) {
+		if *keyPath == "" || *peerKey == "" {
+			return nil, nil, usageError(fs, fs.Name()+" needs -key and -peer")
+		}
+		kp, err := ReadKeyPair(*keyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		peer, err := readPublicKey(*peerKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return kp, peer, nil
+	}
+}
+
+func encryptCommand(args []string, logger *slog.Logger) error {
+	fs := newFlagSet("encrypt", "-key file -peer key < plaintext > ciphertext")
+	keys := cryptFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	kp, peer, err := keys()
+	if err != nil {
+		return err
+	}
+	return encrypt(os.Stdout, os.Stdin, kp, peer)
+}
+
+func decryptCommand(args []string, logger *slog.Logger) error {
+	fs := newFlagSet("decrypt", "-key file -peer key < ciphertext > plaintext")
+	keys := cryptFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	kp, peer, err := keys()
+	if err != nil {
+		return err
+	}
+	return decrypt(os.Stdout, os.Stdin, kp, peer)
+}
+
+// encrypt writes in to out as messages that only peer can decrypt. The
+// messages are in the same format as on a connection. A stream cut short
+// between messages isn't detected by decrypt.
+func encrypt(out io.Writer, in io.Reader, kp *KeyPair, peer *[keySize]byte) error {
+	w := NewSecureWriter(out, kp.priv, peer)
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			// Write reports the encrypted size, so io.Copy can't be used.
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// decrypt reads the messages written by encrypt from in, and writes their
+// plaintext to out.
+func decrypt(out io.Writer, in io.Reader, kp *KeyPair, peer *[keySize]byte) error {
+	r := NewSecureReader(in, kp.priv, peer)
+	// Hide any ReaderFrom so that every message fits in the buffer.
+	_, err := io.CopyBuffer(struct{ io.Writer }{out}, r, make([]byte, maxMessageSize))
+	return err
+}
+
+func versionCommand(args []string, logger *slog.Logger) error {
+	fs := newFlagSet("version", "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	fmt.Printf("%s (%s)\n", version, runtime.Version())
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_run_exitCodes(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		want int
+	}{
+		{nil, exitUsage},
+		{[]string{"help"}, exitOK},
+		{[]string{"help", "dial"}, exitOK},
+		{[]string{"dial", "-h"}, exitOK},
+		{[]string{"dial"}, exitUsage},
+		{[]string{"dial", "-bogus", "1", "x"}, exitUsage},
+		{[]string{"bogus"}, exitUsage},
+		{[]string{"-log-level", "loud", "version"}, exitUsage},
+		{[]string{"fingerprint", "/does/not/exist"}, exitFailure},
+		{[]string{"version"}, exitOK},
+	} {
+		if got := run("test", test.args); got != test.want {
+			t.Errorf("%q: got exit %d, want %d", test.args, got, test.want)
+		}
+	}
+}
+
+func Test_exitStatus(t *testing.T) {
+	if got := exitStatus("test", fmt.Errorf("wrapped: %w", exitCode(3))); got != 3 {
+		t.Errorf("Got %d, want 3", got)
+	}
+	if got := exitStatus("test", io.ErrUnexpectedEOF); got != exitFailure {
+		t.Errorf("Got %d, want %d", got, exitFailure)
+	}
+}
+
+func Test_readPublicKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp := NewKeyPair()
+	path := filepath.Join(dir, "key")
+	if err := WriteKeyPair(path, kp); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{path, hex.EncodeToString(kp.pub[:])} {
+		pub, err := readPublicKey(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *pub != *kp.pub {
+			t.Errorf("%s: got %x, want %x", s, pub, kp.pub)
+		}
+	}
+	if _, err := readPublicKey(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func Test_encrypt_decrypt(t *testing.T) {
+	alice, bob := NewKeyPair(), NewKeyPair()
+	plaintext := make([]byte, 3*maxMessageSize+100)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+
+	var ciphertext bytes.Buffer
+	if err := encrypt(&ciphertext, bytes.NewReader(plaintext), alice, bob.pub); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(ciphertext.Bytes(), plaintext[:64]) {
+		t.Error("Want the plaintext hidden")
+	}
+	encrypted := ciphertext.Bytes()
+
+	var out bytes.Buffer
+	if err := decrypt(&out, bytes.NewReader(encrypted), bob, alice.pub); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), plaintext) {
+		t.Errorf("Got a different plaintext back")
+	}
+
+	eve := NewKeyPair()
+	if err := decrypt(ioutil.Discard, bytes.NewReader(encrypted), eve, alice.pub); err == nil {
+		t.Error("Expected an error decrypting with the wrong key")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+// Config describes how to run the server and clients. It's read from a JSON
+// file given with -config, and flags given on the command line override it.
+//
+//	{
+//	  "listen": ":7000",
+//	  "log_level": "info",
+//	  "mode": "exec",
+//	  "key": "server.key",
+//	  "authorized_keys": "clients.txt",
+//	  "exec": {"deploy": ["/usr/bin/make", "-C", "/srv", "deploy"]},
+//	  "timeouts": {"handshake": "10s", "idle": "5m"},
+//	  "limits": {"max_sessions": 100, "policy": "queue", "frame_rate": {"rate": 100, "burst": 200}}
+//	}
+type Config struct {
+	// Listen is the address the server listens on.
+	Listen string `json:"listen"`
+
+	// Metrics is the address to serve Prometheus metrics on.
+	Metrics string `json:"metrics"`
+
+	// LogLevel is one of error, warn, info, debug or unsafe-trace.
+	LogLevel string `json:"log_level"`
+
+	// Mode is how the server handles clients: echo, stream-echo, forward,
+	// chat, relay or exec. The default is echo.
+	Mode string `json:"mode"`
+
+	// Exec maps command names to the command and arguments to run, in exec
+	// mode.
+	Exec map[string][]string `json:"exec"`
+
+	// Key is the file holding this side's private key.
+	Key string `json:"key"`
+
+	// AuthorizedKeys is the file of client public keys the server accepts.
+	AuthorizedKeys string `json:"authorized_keys"`
+
+	// ServerKey is the hex encoded public key clients expect the server to
+	// present.
+	ServerKey string `json:"server_key"`
+
+	Timeouts TimeoutConfig `json:"timeouts"`
+	Limits   LimitConfig   `json:"limits"`
+}
+
+// TimeoutConfig holds the timeouts in a Config. See Server and the
+// DialOptions for what each one means.
+type TimeoutConfig struct {
+	Dial             Duration `json:"dial"`
+	Handshake        Duration `json:"handshake"`
+	Idle             Duration `json:"idle"`
+	MaxSession       Duration `json:"max_session"`
+	KeepAlive        Duration `json:"keepalive"`
+	KeepAliveTimeout Duration `json:"keepalive_timeout"`
+}
+
+// LimitConfig holds the server's limits in a Config. See Server for what
+// each one means. Policy is reject or queue.
+type LimitConfig struct {
+	MaxSessions        int       `json:"max_sessions"`
+	MaxSessionsPerIP   int       `json:"max_sessions_per_ip"`
+	Policy             string    `json:"policy"`
+	CookieThreshold    int       `json:"cookie_threshold"`
+	HandshakeRate      RateLimit `json:"handshake_rate"`
+	HandshakeRatePerIP RateLimit `json:"handshake_rate_per_ip"`
+	FrameRate          RateLimit `json:"frame_rate"`
+	ByteRate           RateLimit `json:"byte_rate"`
+}
+
+// Duration is a time.Duration written in a Config as a string such as "30s".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("duration must be a string such as \"30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// LoadConfig reads the Config in the file at path. Unknown fields are an
+// error, so that typos don't go unnoticed. The Config isn't validated, since
+// flags may still fill in what it leaves out.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var c Config
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &c, nil
+}
+
+// Validate checks that the Config makes sense. It doesn't read any files.
+func (c *Config) Validate() error {
+	if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			return fmt.Errorf("listen: %s", err)
+		}
+	}
+	if c.LogLevel != "" {
+		if _, err := ParseLevel(c.LogLevel); err != nil {
+			return fmt.Errorf("log_level: %s", err)
+		}
+	}
+	switch c.Mode {
+	case "", "echo", "stream-echo", "forward", "chat", "relay":
+		if len(c.Exec) > 0 {
+			return errors.New("exec: commands are only used in exec mode")
+		}
+		if c.Mode == "forward" && c.AuthorizedKeys == "" {
+			return errors.New("authorized_keys: forward mode needs authorized keys")
+		}
+	case "exec":
+		if len(c.Exec) == 0 {
+			return errors.New("exec: exec mode needs at least one command")
+		}
+		if c.AuthorizedKeys == "" {
+			return errors.New("authorized_keys: exec mode needs authorized keys")
+		}
+		for name, argv := range c.Exec {
+			if name == "" || len(argv) == 0 || argv[0] == "" {
+				return fmt.Errorf("exec: command %q is empty", name)
+			}
+		}
+	default:
+		return fmt.Errorf("mode: unknown mode %q, want echo, stream-echo, forward, chat, relay or exec", c.Mode)
+	}
+	if c.ServerKey != "" {
+		if _, err := ParseKey(c.ServerKey); err != nil {
+			return fmt.Errorf("server_key: %s", err)
+		}
+	}
+
+	t := c.Timeouts
+	for _, d := range []struct {
+		name string
+		v    Duration
+	}{
+		{"dial", t.Dial},
+		{"handshake", t.Handshake},
+		{"idle", t.Idle},
+		{"max_session", t.MaxSession},
+		{"keepalive", t.KeepAlive},
+		{"keepalive_timeout", t.KeepAliveTimeout},
+	} {
+		if d.v < 0 {
+			return fmt.Errorf("timeouts.%s: must not be negative", d.name)
+		}
+	}
+
+	l := c.Limits
+	for _, n := range []struct {
+		name string
+		v    int
+	}{
+		{"max_sessions", l.MaxSessions},
+		{"max_sessions_per_ip", l.MaxSessionsPerIP},
+		{"cookie_threshold", l.CookieThreshold},
+	} {
+		if n.v < 0 {
+			return fmt.Errorf("limits.%s: must not be negative", n.name)
+		}
+	}
+	if _, err := parseLimitPolicy(l.Policy); err != nil {
+		return fmt.Errorf("limits.policy: %s", err)
+	}
+	for _, r := range []struct {
+		name string
+		v    RateLimit
+	}{
+		{"handshake_rate", l.HandshakeRate},
+		{"handshake_rate_per_ip", l.HandshakeRatePerIP},
+		{"frame_rate", l.FrameRate},
+		{"byte_rate", l.ByteRate},
+	} {
+		if r.v.Rate < 0 || r.v.Burst < 0 {
+			return fmt.Errorf("limits.%s: must not be negative", r.name)
+		}
+	}
+	return nil
+}
+
+func parseLimitPolicy(s string) (LimitPolicy, error) {
+	switch s {
+	case "", "reject":
+		return LimitReject, nil
+	case "queue":
+		return LimitQueue, nil
+	}
+	return 0, fmt.Errorf("unknown policy %q, want reject or queue", s)
+}
+
+// NewServer creates a Server as described by the Config, reading its key
+// files. Its Handler is chosen by Mode and logs to logger.
+func (c *Config) NewServer(logger *slog.Logger) (*Server, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	kp := NewKeyPair()
+	if c.Key != "" {
+		var err error
+		if kp, err = ReadKeyPair(c.Key); err != nil {
+			return nil, err
+		}
+	}
+	s := NewServer(kp)
+	s.Logger = logger
+	if c.AuthorizedKeys != "" {
+		keys, err := ReadAuthorizedKeys(c.AuthorizedKeys)
+		if err != nil {
+			return nil, err
+		}
+		s.OnHandshake = keys.Check
+	}
+
+	s.HandshakeTimeout = time.Duration(c.Timeouts.Handshake)
+	s.IdleTimeout = time.Duration(c.Timeouts.Idle)
+	s.MaxSessionLifetime = time.Duration(c.Timeouts.MaxSession)
+	s.KeepAlive = time.Duration(c.Timeouts.KeepAlive)
+	s.KeepAliveTimeout = time.Duration(c.Timeouts.KeepAliveTimeout)
+
+	s.MaxSessions = c.Limits.MaxSessions
+	s.MaxSessionsPerIP = c.Limits.MaxSessionsPerIP
+	s.LimitPolicy, _ = parseLimitPolicy(c.Limits.Policy)
+	s.CookieThreshold = c.Limits.CookieThreshold
+	s.HandshakeRate = c.Limits.HandshakeRate
+	s.HandshakeRatePerIP = c.Limits.HandshakeRatePerIP
+	s.FrameRate = c.Limits.FrameRate
+	s.ByteRate = c.Limits.ByteRate
+
+	switch c.Mode {
+	case "stream-echo":
+		s.Handler = StreamEchoHandler
+	case "forward":
+		s.Handler = &Forwarder{Authorize: s.OnHandshake, Logger: logger}
+	case "chat":
+		s.Handler = &ChatRoom{Logger: logger}
+	case "relay":
+		s.Handler = &Relay{Logger: logger}
+	case "exec":
+		s.Handler = &Executor{Commands: c.Exec, Authorize: s.OnHandshake, Logger: logger}
+	}
+	return s, nil
+}
+
+// DialOptions returns the options for a client described by the Config,
+// reading its key file.
+func (c *Config) DialOptions() ([]DialOption, error) {
+	var opts []DialOption
+	if c.Key != "" {
+		kp, err := ReadKeyPair(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithKeyPair(kp))
+	}
+	if c.ServerKey != "" {
+		k, err := ParseKey(c.ServerKey)
+		if err != nil {
+			return nil, fmt.Errorf("server_key: %s", err)
+		}
+		opts = append(opts, WithServerKey(k))
+	}
+	if c.Timeouts.Dial > 0 {
+		opts = append(opts, WithDialTimeout(time.Duration(c.Timeouts.Dial)))
+	}
+	if c.Timeouts.Handshake > 0 {
+		opts = append(opts, WithHandshakeTimeout(time.Duration(c.Timeouts.Handshake)))
+	}
+	if c.Timeouts.KeepAlive > 0 {
+		opts = append(opts, WithKeepAlive(time.Duration(c.Timeouts.KeepAlive), time.Duration(c.Timeouts.KeepAliveTimeout)))
+	}
+	return opts, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, dir, body string) string {
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_LoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kp := NewKeyPair()
+	keyPath := filepath.Join(dir, "key")
+	if err := WriteKeyPair(keyPath, kp); err != nil {
+		t.Fatal(err)
+	}
+	client := NewKeyPair()
+	authPath := filepath.Join(dir, "authorized")
+	if err := ioutil.WriteFile(authPath, []byte(hex.EncodeToString(client.pub[:])+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeConfig(t, dir, `{
+		"listen": ":7000",
+		"log_level": "info",
+		"mode": "exec",
+		"key": "`+keyPath+`",
+		"authorized_keys": "`+authPath+`",
+		"exec": {"true": ["true"]},
+		"timeouts": {"handshake": "10s", "idle": "5m", "keepalive": "30s"},
+		"limits": {"max_sessions": 100, "policy": "queue", "frame_rate": {"rate": 100, "burst": 200}}
+	}`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := cfg.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *s.keyPair.pub != *kp.pub {
+		t.Errorf("Want the server to use the key file")
+	}
+	if s.OnHandshake == nil || s.OnHandshake(client.pub) != nil || s.OnHandshake(kp.pub) == nil {
+		t.Errorf("Want the server to only accept authorized keys")
+	}
+	if _, ok := s.Handler.(*Executor); !ok {
+		t.Errorf("Got handler %T, want *Executor", s.Handler)
+	}
+	if s.HandshakeTimeout != 10*time.Second || s.IdleTimeout != 5*time.Minute || s.KeepAlive != 30*time.Second {
+		t.Errorf("Got timeouts %s %s %s", s.HandshakeTimeout, s.IdleTimeout, s.KeepAlive)
+	}
+	if s.MaxSessions != 100 || s.LimitPolicy != LimitQueue || s.FrameRate != (RateLimit{Rate: 100, Burst: 200}) {
+		t.Errorf("Got limits %d %d %v", s.MaxSessions, s.LimitPolicy, s.FrameRate)
+	}
+
+	opts, err := cfg.DialOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dc dialConfig
+	for _, opt := range opts {
+		opt(&dc)
+	}
+	if dc.keyPair == nil || *dc.keyPair.pub != *kp.pub {
+		t.Errorf("Want the client to use the key file")
+	}
+	if dc.handshakeTimeout != 10*time.Second || dc.keepAlive != 30*time.Second {
+		t.Errorf("Got timeouts %s %s", dc.handshakeTimeout, dc.keepAlive)
+	}
+}
+
+func Test_LoadConfig_errors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		body string
+		want string
+	}{
+		{`{"listen": ":7000",}`, "invalid character"},
+		{`{"lisen": ":7000"}`, `unknown field "lisen"`},
+		{`{"listen": "7000"}`, "listen:"},
+		{`{"log_level": "loud"}`, "log_level:"},
+		{`{"mode": "proxy"}`, "mode:"},
+		{`{"mode": "exec", "exec": {"true": ["true"]}}`, "authorized_keys:"},
+		{`{"mode": "forward"}`, "authorized_keys:"},
+		{`{"mode": "exec", "authorized_keys": "a"}`, "exec:"},
+		{`{"exec": {"true": ["true"]}}`, "exec:"},
+		{`{"server_key": "abc"}`, "server_key:"},
+		{`{"timeouts": {"idle": 300}}`, "duration must be a string"},
+		{`{"timeouts": {"idle": "-1s"}}`, "timeouts.idle:"},
+		{`{"limits": {"max_sessions": -1}}`, "limits.max_sessions:"},
+		{`{"limits": {"policy": "drop"}}`, "limits.policy:"},
+		{`{"limits": {"frame_rate": {"rate": -1}}}`, "limits.frame_rate:"},
+	} {
+		path := writeConfig(t, dir, test.body)
+		cfg, err := LoadConfig(path)
+		if err == nil {
+			err = cfg.Validate()
+		} else if !strings.HasPrefix(err.Error(), path+": ") {
+			t.Errorf("%s: got %q, want it to start with the path", test.body, err)
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", test.body)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %q, want it to contain %q", test.body, err, test.want)
+		}
+	}
+}
+
+func Test_serverFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeConfig(t, dir, `{"key": "from-config", "authorized_keys": "from-config"}`)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	loadConfig := serverFlags(fs)
+	if err := fs.Parse([]string{"-config", path, "-key", "from-flag"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Key != "from-flag" {
+		t.Errorf("Got key %q, want the flag to override the config", cfg.Key)
+	}
+	if cfg.AuthorizedKeys != "from-config" {
+		t.Errorf("Got authorized keys %q, want the config's", cfg.AuthorizedKeys)
+	}
+}
+
+func Test_serverFlags_incompleteConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeConfig(t, dir, `{"mode": "exec"}`)
+
+	// The file alone isn't valid, but the flags complete it.
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	loadConfig := serverFlags(fs)
+	if err := fs.Parse([]string{"-config", path, "-authorized-keys", "keys"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Exec = map[string][]string{"x": {"/bin/echo", "hi"}}
+	if err := cfg.Validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Conn is an authenticated, encrypted session with a peer, as seen by a
+// Handler. Each Write of up to maxMessageSize bytes is sent as a single
+// message, and each Read returns data from at most one message, so protocols
+// that need message boundaries can rely on them.
+type Conn struct {
+	r       io.Reader
+	w       io.Writer
+	closer  io.Closer
+	session Session
+	mr      *messageReader
+
+	wmu  sync.Mutex
+	rbuf []byte
+	buf  []byte
+}
+
+// newConn returns a Conn that reads and writes messages with r and w.
+func newConn(r io.Reader, w io.Writer, closer io.Closer, session Session) *Conn {
+	return &Conn{r: r, w: w, closer: closer, session: session}
+}
+
+// Session returns details of the authenticated peer.
+func (c *Conn) Session() Session {
+	return c.session
+}
+
+// Read implements io.Reader. If buf is too small for the next message, the
+// rest is returned by the following Reads.
+func (c *Conn) Read(buf []byte) (int, error) {
+	if len(c.buf) == 0 {
+		if c.rbuf == nil {
+			c.rbuf = make([]byte, maxMessageSize)
+		}
+		n, err := c.r.Read(c.rbuf)
+		if err != nil {
+			return 0, err
+		}
+		c.buf = c.rbuf[:n]
+	}
+	n := copy(buf, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Write implements io.Writer, splitting buf into as many messages as needed.
+// It's safe to call Write from multiple goroutines.
+func (c *Conn) Write(buf []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var written int
+	for len(buf) > 0 {
+		chunk := buf
+		if uint64(len(chunk)) > maxMessageSize {
+			chunk = chunk[:maxMessageSize]
+		}
+		if _, err := c.w.Write(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		buf = buf[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error {
+	if c.mr != nil {
+		c.mr.close(net.ErrClosed)
+	}
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+// CloseWrite tells the peer that no more data will be written, if the
+// underlying connection supports it. The Conn can still be read.
+func (c *Conn) CloseWrite() error {
+	return closeWrite(c.closer)
+}
+
+// closeWrite shuts down the writing side of c if it has a CloseWrite method,
+// as TCP and Unix connections do.
+func closeWrite(c interface{}) error {
+	if cw, ok := c.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Handler serves a client's session once the handshake is done. The
+// connection is closed when ServeSession returns.
+type Handler interface {
+	ServeSession(c *Conn) error
+}
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(c *Conn) error
+
+// ServeSession calls f(c).
+func (f HandlerFunc) ServeSession(c *Conn) error {
+	return f(c)
+}
+
+// EchoHandler is the Server's default Handler. It reads one message from the
+// client and writes it back.
+var EchoHandler = HandlerFunc(func(c *Conn) error {
+	buf := make([]byte, maxMessageSize)
+	n, err := c.Read(buf)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(buf[:n])
+	return err
+})
+
+// StreamEchoHandler writes back every message from the client until the
+// client closes its side of the connection.
+var StreamEchoHandler = HandlerFunc(func(c *Conn) error {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := c.Read(buf)
+		if err == io.EOF {
+			return c.CloseWrite()
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := c.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+})
+
+// messageReader reads messages in the background, so that control messages
+// are handled even while nobody is reading data. Each Read returns data from
+// at most one message.
+type messageReader struct {
+	msgs chan []byte
+	stop chan struct{}
+	done chan struct{}
+	buf  []byte
+
+	mu      sync.Mutex
+	err     error
+	stopErr error
+}
+
+func newMessageReader(r io.Reader) *messageReader {
+	m := &messageReader{
+		msgs: make(chan []byte),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go m.run(r)
+	return m
+}
+
+func (m *messageReader) run(r io.Reader) {
+	defer close(m.done)
+	defer close(m.msgs)
+	for {
+		buf := make([]byte, maxMessageSize)
+		n, err := r.Read(buf)
+		if err != nil {
+			m.mu.Lock()
+			m.err = err
+			m.mu.Unlock()
+			return
+		}
+		select {
+		case m.msgs <- buf[:n]:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Read implements io.Reader. If buf is too small for the next message, the
+// rest is returned by the following Reads.
+func (m *messageReader) Read(buf []byte) (int, error) {
+	if len(m.buf) == 0 {
+		msg, ok := <-m.msgs
+		if !ok {
+			return 0, m.error()
+		}
+		m.buf = msg
+	}
+	n := copy(buf, m.buf)
+	m.buf = m.buf[n:]
+	return n, nil
+}
+
+// pending reports whether a message has arrived that hasn't been read in
+// full. It mustn't be called at the same time as Read.
+func (m *messageReader) pending() bool {
+	if len(m.buf) > 0 {
+		return true
+	}
+	select {
+	case msg, ok := <-m.msgs:
+		if ok {
+			m.buf = msg
+			return true
+		}
+	default:
+	}
+	return false
+}
+
+// close stops reading. Once the underlying reader has returned, Read fails
+// with err.
+func (m *messageReader) close(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopErr == nil {
+		m.stopErr = err
+		close(m.stop)
+	}
+}
+
+// error returns why reading stopped.
+func (m *messageReader) error() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopErr != nil {
+		return m.stopErr
+	}
+	return m.err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// messageRW records each Write as a separate message and returns one message
+// per Read, like a secure connection.
+type messageRW struct {
+	msgs [][]byte
+}
+
+func (m *messageRW) Read(buf []byte) (int, error) {
+	if len(m.msgs) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(buf, m.msgs[0])
+	m.msgs = m.msgs[1:]
+	return n, nil
+}
+
+func (m *messageRW) Write(buf []byte) (int, error) {
+	m.msgs = append(m.msgs, append([]byte(nil), buf...))
+	return len(buf), nil
+}
+
+func Test_Conn_Read(t *testing.T) {
+	rw := &messageRW{msgs: [][]byte{[]byte("hello world"), []byte("bye")}}
+	c := newConn(rw, rw, nil, Session{})
+
+	var got []string
+	buf := make([]byte, 4)
+	for {
+		n, err := c.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(buf[:n]))
+	}
+	want := []string{"hell", "o wo", "rld", "bye"}
+	if len(got) != len(want) {
+		t.Fatalf("Got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Got %q, want %q", got, want)
+		}
+	}
+}
+
+func Test_Conn_Write(t *testing.T) {
+	rw := &messageRW{}
+	c := newConn(rw, rw, nil, Session{})
+
+	data := bytes.Repeat([]byte("x"), int(maxMessageSize)*2+10)
+	n, err := c.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Errorf("Got %d, want %d", n, len(data))
+	}
+	if len(rw.msgs) != 3 {
+		t.Fatalf("Got %d messages, want 3", len(rw.msgs))
+	}
+	if len(rw.msgs[2]) != 10 {
+		t.Errorf("Got %d bytes in the last message, want 10", len(rw.msgs[2]))
+	}
+}
+
+func Test_EchoHandler(t *testing.T) {
+	rw := &messageRW{msgs: [][]byte{[]byte("hello")}}
+	c := newConn(rw, rw, nil, Session{})
+
+	if err := EchoHandler.ServeSession(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(rw.msgs) != 1 || string(rw.msgs[0]) != "hello" {
+		t.Errorf("Got %q, want hello echoed", rw.msgs)
+	}
+}
+
+func Test_StreamEchoHandler(t *testing.T) {
+	in := &messageRW{msgs: [][]byte{[]byte("one"), []byte("two")}}
+	out := &messageRW{}
+	c := newConn(in, out, nil, Session{})
+
+	if err := StreamEchoHandler.ServeSession(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.msgs) != 2 || string(out.msgs[0]) != "one" || string(out.msgs[1]) != "two" {
+		t.Errorf("Got %q, want both messages echoed", out.msgs)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// A server under load may answer a client's public key with a cookie instead
+// of its own public key. The client must then reconnect and present the
+// cookie before its key, proving that it can receive traffic at its address.
+// Only then does the server spend time on the key agreement.
+//
+// Cookie messages start with cookieMarker where a public key is expected. The
+// marker is a low order point, so it can never be mistaken for a real key.
+
+const (
+	cookieSize = sha256.Size
+
+	// cookieLifetime is how long a cookie is accepted. A cookie is valid in
+	// the period it was made and the one after.
+	cookieLifetime = 2 * time.Minute
+)
+
+var cookieMarker [keySize]byte
+
+var (
+	// ErrCookieRequired is returned by Client.Handshake when the server is
+	// under load and replied with a cookie. Handshaking again on a new
+	// connection presents the cookie.
+	ErrCookieRequired = errors.New("server requires a cookie")
+
+	// ErrInvalidCookie is returned when a client presents a cookie that is
+	// forged, expired or was issued to another address.
+	ErrInvalidCookie = errors.New("invalid cookie from peer")
+
+	// errCookieSent is returned by Server.handshake after sending a cookie.
+	errCookieSent = errors.New("sent cookie to client")
+)
+
+// cookieJar makes and checks cookies bound to the client's IP address. It is
+// stateless apart from a secret chosen the first time it's used.
+type cookieJar struct {
+	once   sync.Once
+	secret [32]byte
+}
+
+// make returns the cookie for ip at time t.
+func (j *cookieJar) make(ip string, t time.Time) []byte {
+	j.once.Do(func() {
+		if _, err := io.ReadFull(rand.Reader, j.secret[:]); err != nil {
+			panic(err)
+		}
+	})
+	var period [8]byte
+	binary.BigEndian.PutUint64(period[:], uint64(t.Unix()/int64(cookieLifetime/time.Second)))
+
+	mac := hmac.New(sha256.New, j.secret[:])
+	mac.Write(period[:])
+	mac.Write([]byte(ip))
+	return mac.Sum(nil)
+}
+
+// valid reports whether cookie was made for ip recently.
+func (j *cookieJar) valid(cookie []byte, ip string, now time.Time) bool {
+	return hmac.Equal(cookie, j.make(ip, now)) ||
+		hmac.Equal(cookie, j.make(ip, now.Add(-cookieLifetime)))
+}
+
+// sendCookie writes a cookie message.
+func sendCookie(w io.Writer, cookie []byte) error {
+	msg := make([]byte, 0, keySize+cookieSize)
+	msg = append(msg, cookieMarker[:]...)
+	msg = append(msg, cookie...)
+	_, err := w.Write(msg)
+	return err
+}
+
+// recvHello reads either the peer's public key, or a cookie message followed
+// by the peer's public key. The cookie is nil if none was sent. If the peer
+// sent a cookie message instead of a key, the returned KeyPair is nil.
+func (kp KeyPair) recvHello(r io.Reader, keyFollows bool) (*KeyPair, []byte, error) {
+	var pub [keySize]byte
+	if _, err := io.ReadFull(r, pub[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, nil, ErrShortKey
+		}
+		return nil, nil, err
+	}
+	if pub != cookieMarker {
+		peer, err := kp.withPeer(&pub)
+		return peer, nil, err
+	}
+
+	cookie := make([]byte, cookieSize)
+	if _, err := io.ReadFull(r, cookie); err != nil {
+		return nil, nil, err
+	}
+	if !keyFollows {
+		return nil, cookie, nil
+	}
+	peer, err := kp.recv(r)
+	return peer, cookie, err
+}
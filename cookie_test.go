@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_cookieJar_valid(t *testing.T) {
+	var j cookieJar
+	now := time.Now()
+	cookie := j.make("10.0.0.1", now)
+
+	if len(cookie) != cookieSize {
+		t.Fatalf("Got %d byte cookie, want %d", len(cookie), cookieSize)
+	}
+	if !j.valid(cookie, "10.0.0.1", now) {
+		t.Errorf("Want cookie to be valid")
+	}
+	if !j.valid(cookie, "10.0.0.1", now.Add(cookieLifetime)) {
+		t.Errorf("Want cookie to be valid in the next period")
+	}
+	if j.valid(cookie, "10.0.0.1", now.Add(2*cookieLifetime)) {
+		t.Errorf("Want cookie to expire")
+	}
+	if j.valid(cookie, "10.0.0.2", now) {
+		t.Errorf("Want cookie to be bound to the address")
+	}
+
+	var other cookieJar
+	if other.valid(cookie, "10.0.0.1", now) {
+		t.Errorf("Want cookie from another jar to be invalid")
+	}
+}
+
+func Test_KeyPair_recvHello(t *testing.T) {
+	kp := newFakeKeyPair("a", "b")
+	peersPub := [32]byte{'c'}
+	cookie := bytes.Repeat([]byte{'x'}, cookieSize)
+
+	// Key only.
+	peer, got, err := kp.recvHello(bytes.NewReader(peersPub[:]), true)
+	if err != nil || got != nil || *peer.pub != peersPub {
+		t.Errorf("Got %v %x %v, want key and no cookie", peer, got, err)
+	}
+
+	// Cookie and key.
+	buf := &bytes.Buffer{}
+	sendCookie(buf, cookie)
+	buf.Write(peersPub[:])
+	peer, got, err = kp.recvHello(buf, true)
+	if err != nil || !bytes.Equal(got, cookie) || *peer.pub != peersPub {
+		t.Errorf("Got %v %x %v, want key and cookie", peer, got, err)
+	}
+
+	// Cookie only.
+	buf.Reset()
+	sendCookie(buf, cookie)
+	peer, got, err = kp.recvHello(buf, false)
+	if err != nil || !bytes.Equal(got, cookie) || peer != nil {
+		t.Errorf("Got %v %x %v, want cookie and no key", peer, got, err)
+	}
+}
+
+func Test_Server_handshake_underLoad(t *testing.T) {
+	kp := newFakeKeyPair("a", "b")
+	s := NewServer(kp)
+	s.CookieThreshold = 1
+	atomic.AddInt64(&s.handshaking, 1)
+
+	// Fake a io.ReadWriter
+	clientPub := [32]byte{'p', 'u', 'b'}
+	r := bytes.NewBuffer(clientPub[:])
+	w := &bytes.Buffer{}
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{r, w}
+
+	if _, err := s.handshake(rw, "10.0.0.1"); err != errCookieSent {
+		t.Fatalf("Got error %v, want %v", err, errCookieSent)
+	}
+
+	// The server sent a cookie instead of its key.
+	if !bytes.HasPrefix(w.Bytes(), cookieMarker[:]) {
+		t.Fatalf("Got %x, want a cookie message", w.Bytes())
+	}
+	cookie := w.Bytes()[keySize:]
+
+	// The client comes back with the cookie.
+	r.Reset()
+	w.Reset()
+	sendCookie(r, cookie)
+	r.Write(clientPub[:])
+
+	peer, err := s.handshake(rw, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("Handshake got error %s", err)
+	}
+	if peer == nil || *peer.pub != clientPub {
+		t.Errorf("Got %v, want client's key", peer)
+	}
+	if !bytes.Equal(w.Bytes(), kp.pub[:]) {
+		t.Errorf("Send key: got %#v, want %#v", w.Bytes(), kp.pub)
+	}
+
+	// A cookie from another address is rejected.
+	r.Reset()
+	sendCookie(r, cookie)
+	r.Write(clientPub[:])
+	if _, err := s.handshake(rw, "10.0.0.2"); err != ErrInvalidCookie {
+		t.Errorf("Got error %v, want %v", err, ErrInvalidCookie)
+	}
+}
+
+func Test_Dial_cookie(t *testing.T) {
+	// Pretend the server is always under load.
+	s := NewServer(NewKeyPair())
+	s.CookieThreshold = 1
+	atomic.AddInt64(&s.handshaking, 1)
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	conn, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != "hello" {
+		t.Errorf("Got %s, want hello", got)
+	}
+}
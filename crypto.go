@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 
@@ -10,6 +14,44 @@ import (
 
 const keySize = 32
 
+var (
+	// ErrShortKey is returned when the peer hangs up before sending an entire
+	// public key.
+	ErrShortKey = errors.New("short public key from peer")
+
+	// ErrInvalidKey is returned when the peer's public key is zero or a low
+	// order point. Any such key yields a common key known to an attacker.
+	ErrInvalidKey = errors.New("invalid public key from peer")
+
+	// ErrReflectedKey is returned when the peer sends our own public key back
+	// to us.
+	ErrReflectedKey = errors.New("peer sent our own public key")
+
+	// ErrUnexpectedKey is returned when the server's public key isn't the
+	// one the client expects.
+	ErrUnexpectedKey = errors.New("unexpected public key from server")
+)
+
+// lowOrderPoints are the Curve25519 points of small order, including their
+// non-canonical encodings. The top bit is ignored by Curve25519 and must be
+// cleared before comparing. See https://cr.yp.to/ecdh.html#validate.
+var lowOrderPoints = [][keySize]byte{
+	// 0 (order 4)
+	{},
+	// 1 (order 1)
+	{0x01},
+	// 325606250916557431795983626356110631294008115727848805560023387167927233504 (order 8)
+	{0xe0, 0xeb, 0x7a, 0x7c, 0x3b, 0x41, 0xb8, 0xae, 0x16, 0x56, 0xe3, 0xfa, 0xf1, 0x9f, 0xc4, 0x6a, 0xda, 0x09, 0x8d, 0xeb, 0x9c, 0x32, 0xb1, 0xfd, 0x86, 0x62, 0x05, 0x16, 0x5f, 0x49, 0xb8, 0x00},
+	// 39382357235489614581723060781553021112529911719440698176882885853963445705823 (order 8)
+	{0x5f, 0x9c, 0x95, 0xbc, 0xa3, 0x50, 0x8c, 0x24, 0xb1, 0xd0, 0xb1, 0x55, 0x9c, 0x83, 0xef, 0x5b, 0x04, 0x44, 0x5c, 0xc4, 0x58, 0x1c, 0x8e, 0x86, 0xd8, 0x22, 0x4e, 0xdd, 0xd0, 0x9f, 0x11, 0x57},
+	// p-1 (order 2)
+	{0xec, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	// p (=0, order 4)
+	{0xed, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	// p+1 (=1, order 1)
+	{0xee, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+}
+
 // KeyPair holds a public/private key pair, and facilitiates performing
 // a Diffie-Hellman key exchange.
 type KeyPair struct {
@@ -38,22 +80,50 @@ func (kp KeyPair) Exchange(rw io.ReadWriter) (*KeyPair, error) {
 }
 
 func (kp *KeyPair) send(w io.Writer) error {
-	debugf("Sending public key %v\n", kp.pub)
-	if _, err := w.Write(kp.pub[:]); err != nil {
-		return err
-	}
-	debugf("Sent public key %v\n", kp.pub)
-	return nil
+	_, err := w.Write(kp.pub[:])
+	return err
 }
 
 func (kp KeyPair) recv(r io.Reader) (*KeyPair, error) {
-	newPair := &KeyPair{pub: &[keySize]byte{}, priv: kp.priv}
-	debugf("Receiving...\n")
-	if _, err := r.Read(newPair.pub[:]); err != nil {
+	var pub [keySize]byte
+	if _, err := io.ReadFull(r, pub[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrShortKey
+		}
+		return nil, err
+	}
+	return kp.withPeer(&pub)
+}
+
+// withPeer returns a new KeyPair with the peer's public key and this private
+// key, after checking that the peer's key is safe to use.
+func (kp KeyPair) withPeer(pub *[keySize]byte) (*KeyPair, error) {
+	if *pub == *kp.pub {
+		return nil, ErrReflectedKey
+	}
+	if err := checkPublicKey(pub); err != nil {
 		return nil, err
 	}
-	debugf("Received peer's public key: %v\n", newPair.pub)
-	return newPair, nil
+	return &KeyPair{pub: pub, priv: kp.priv}, nil
+}
+
+// checkPublicKey returns ErrInvalidKey if pub is one of the low order points.
+func checkPublicKey(pub *[keySize]byte) error {
+	k := *pub
+	k[keySize-1] &= 0x7f
+	for _, p := range lowOrderPoints {
+		if bytes.Equal(k[:], p[:]) {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
+
+// Fingerprint returns a short identifier for a public key, suitable for logs
+// and for people to compare.
+func Fingerprint(pub *[keySize]byte) string {
+	sum := sha256.Sum256(pub[:])
+	return hex.EncodeToString(sum[:8])
 }
 
 // CommonKey returns the shared key computed with the public key and the
@@ -5,7 +5,9 @@ import (
 	"crypto/rand"
 	"io"
 	"testing"
+	"testing/iotest"
 
+	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/nacl/box"
 )
 
@@ -61,6 +63,69 @@ func Test_KeyPair_Exchange(t *testing.T) {
 	}
 }
 
+func Test_KeyPair_recv_fragmented(t *testing.T) {
+	kp := newFakeKeyPair("a", "b")
+	peersPub := [32]byte{'c', 31: 'd'}
+
+	// Deliver the key one byte at a time.
+	r := iotest.OneByteReader(bytes.NewReader(peersPub[:]))
+
+	kp2, err := kp.recv(r)
+	if err != nil {
+		t.Fatalf("recv got error %s", err)
+	}
+	if *kp2.pub != peersPub {
+		t.Errorf("Recv pub key: got %#v, want %#v", kp2.pub, peersPub)
+	}
+}
+
+func Test_KeyPair_recv_errors(t *testing.T) {
+	kp := newFakeKeyPair("a", "b")
+
+	high := lowOrderPoints[1]
+	high[31] |= 0x80
+
+	tests := []struct {
+		name string
+		in   []byte
+		want error
+	}{
+		{"empty", nil, io.EOF},
+		{"short", []byte{'c', 'd'}, ErrShortKey},
+		{"zero", make([]byte, 32), ErrInvalidKey},
+		{"high bit", high[:], ErrInvalidKey},
+		{"reflected", kp.pub[:], ErrReflectedKey},
+	}
+	for _, test := range tests {
+		_, err := kp.recv(bytes.NewReader(test.in))
+		if err != test.want {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func Test_checkPublicKey(t *testing.T) {
+	scalar := make([]byte, 32)
+	if _, err := rand.Read(scalar); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range lowOrderPoints {
+		p := p
+		if err := checkPublicKey(&p); err != ErrInvalidKey {
+			t.Errorf("Got %v for %x, want %v", err, p, ErrInvalidKey)
+		}
+		// Cross-check against the X25519 implementation.
+		if _, err := curve25519.X25519(scalar, p[:]); err == nil {
+			t.Errorf("Want %x to be a low order point", p)
+		}
+	}
+
+	pub, _, _ := box.GenerateKey(rand.Reader)
+	if err := checkPublicKey(pub); err != nil {
+		t.Errorf("Got %v, want no error for a generated key", err)
+	}
+}
+
 func Test_KeyPair_CommonKey(t *testing.T) {
 	kp := &KeyPair{
 		&[32]byte{'a'},
@@ -154,3 +219,17 @@ func Test_Nonce_NonceFrom_fail(t *testing.T) {
 		t.Errorf("Want error")
 	}
 }
+
+func Test_Fingerprint(t *testing.T) {
+	a := Fingerprint(&[32]byte{'a'})
+	b := Fingerprint(&[32]byte{'b'})
+	if len(a) != 16 {
+		t.Errorf("Got %q, want 16 hex digits", a)
+	}
+	if a == b {
+		t.Errorf("Want different keys to have different fingerprints")
+	}
+	if a != Fingerprint(&[32]byte{'a'}) {
+		t.Errorf("Want fingerprint to be stable")
+	}
+}
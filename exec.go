@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Remote commands run over a MuxSession, one command at a time. The client
+// opens a stream and sends an execRequest naming the command. The server
+// replies with an execReply, then opens a stream for each of stdout and
+// stderr, each starting with an execOutput header. The rest of the client's
+// stream is the command's stdin. Once the command exits and its output has
+// been sent, the server sends an execExit on the client's stream.
+
+type execRequest struct {
+	Command string `json:"command"`
+}
+
+type execReply struct {
+	Error string `json:"error,omitempty"`
+}
+
+type execOutput struct {
+	Name string `json:"name"`
+}
+
+type execExit struct {
+	Code  int    `json:"code"`
+	Error string `json:"error,omitempty"`
+}
+
+// Executor is a Handler that runs allowlisted commands for authorized
+// clients.
+type Executor struct {
+	// Commands maps the names clients may ask for to the command and
+	// arguments to run. Clients can't pass arguments of their own.
+	Commands map[string][]string
+
+	// Authorize is called with the client's public key before running a
+	// command. Returning an error refuses the command. If nil, every
+	// command is refused.
+	Authorize func(peer *[keySize]byte) error
+
+	// Logger, if set, receives a message for each command run.
+	Logger *slog.Logger
+}
+
+// ServeSession implements Handler.
+func (e *Executor) ServeSession(c *Conn) error {
+	sess := c.Session()
+	return MuxHandler(func(m *MuxSession) error {
+		for {
+			st, err := m.AcceptStream()
+			if err != nil {
+				return err
+			}
+			if err := e.run(sess, m, st); err != nil {
+				orDiscard(e.Logger).Debug("exec ended", "session", sess.ID, "err", err)
+			}
+			st.Close()
+		}
+	}).ServeSession(c)
+}
+
+func (e *Executor) run(sess Session, m *MuxSession, st *Stream) error {
+	var req execRequest
+	if err := readHeader(st, &req); err != nil {
+		return err
+	}
+	log := orDiscard(e.Logger).With("session", sess.ID, "peer", Fingerprint(&sess.Peer), "command", req.Command)
+
+	argv, err := e.command(&sess.Peer, req.Command)
+	if err != nil {
+		log.Info("exec refused", "err", err)
+		writeHeader(st, execReply{Error: err.Error()})
+		return err
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		writeHeader(st, execReply{Error: err.Error()})
+		return err
+	}
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		writeHeader(st, execReply{Error: err.Error()})
+		return err
+	}
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		writeHeader(st, execReply{Error: err.Error()})
+		return err
+	}
+	// The output streams are opened only once the command has started, so
+	// a command that fails to start leaves nothing for the client to accept.
+	if err := cmd.Start(); err != nil {
+		log.Warn("exec failed", "err", err)
+		writeHeader(st, execReply{Error: err.Error()})
+		return err
+	}
+	log.Info("exec started")
+	kill := func(err error) error {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if err := writeHeader(st, execReply{}); err != nil {
+		return kill(err)
+	}
+	stdout, err := openOutput(m, "stdout")
+	if err != nil {
+		return kill(err)
+	}
+	defer stdout.Close()
+	stderr, err := openOutput(m, "stderr")
+	if err != nil {
+		return kill(err)
+	}
+	defer stderr.Close()
+	go func() {
+		io.Copy(stdin, st)
+		stdin.Close()
+	}()
+
+	// Wait closes the pipes, so the output is copied before waiting.
+	var wg sync.WaitGroup
+	for _, out := range []struct {
+		st *Stream
+		r  io.Reader
+	}{{stdout, stdoutPipe}, {stderr, stderrPipe}} {
+		wg.Add(1)
+		go func(st *Stream, r io.Reader) {
+			defer wg.Done()
+			if _, err := io.Copy(st, r); err != nil {
+				// Keep draining so the command doesn't block writing.
+				io.Copy(io.Discard, r)
+			}
+			st.CloseWrite()
+		}(out.st, out.r)
+	}
+	wg.Wait()
+
+	var exit execExit
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exit.Code = exitErr.ExitCode()
+		} else {
+			exit.Code = -1
+			exit.Error = err.Error()
+		}
+	}
+	log.Info("exec finished", "code", exit.Code)
+	return writeHeader(st, exit)
+}
+
+// command returns the command to run for name, if the peer may run it.
+func (e *Executor) command(peer *[keySize]byte, name string) ([]string, error) {
+	if e.Authorize == nil {
+		return nil, ErrUnauthorizedKey
+	}
+	if err := e.Authorize(peer); err != nil {
+		return nil, err
+	}
+	argv := e.Commands[name]
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("unknown command %q", name)
+	}
+	return argv, nil
+}
+
+func openOutput(m *MuxSession, name string) (*Stream, error) {
+	st, err := m.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeHeader(st, execOutput{Name: name}); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// RunCommand asks the Executor at the other end of m to run the named
+// command. It sends stdin, which may be nil, to the command and copies the
+// command's output to stdout and stderr. It returns the command's exit code.
+// Commands on the same session must run one after another.
+func RunCommand(m *MuxSession, name string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	st, err := m.OpenStream()
+	if err != nil {
+		return -1, err
+	}
+	defer st.Close()
+	if err := writeHeader(st, execRequest{Command: name}); err != nil {
+		return -1, err
+	}
+	var reply execReply
+	if err := readHeader(st, &reply); err != nil {
+		return -1, err
+	}
+	if reply.Error != "" {
+		return -1, fmt.Errorf("exec: %s", reply.Error)
+	}
+
+	if stdin == nil {
+		st.CloseWrite()
+	} else {
+		go func() {
+			io.Copy(st, stdin)
+			st.CloseWrite()
+		}()
+	}
+
+	outputs := map[string]io.Writer{"stdout": stdout, "stderr": stderr}
+	var wg sync.WaitGroup
+	errc := make(chan error, len(outputs))
+	for len(outputs) > 0 {
+		out, err := m.AcceptStream()
+		if err != nil {
+			return -1, err
+		}
+		var hdr execOutput
+		if err := readHeader(out, &hdr); err != nil {
+			out.Close()
+			return -1, err
+		}
+		w, ok := outputs[hdr.Name]
+		if !ok {
+			out.Close()
+			return -1, fmt.Errorf("exec: unexpected output %q", hdr.Name)
+		}
+		delete(outputs, hdr.Name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer out.Close()
+			if w == nil {
+				w = io.Discard
+			}
+			if _, err := io.Copy(w, out); err != nil {
+				errc <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errc)
+	if err := <-errc; err != nil {
+		return -1, err
+	}
+
+	var exit execExit
+	if err := readHeader(st, &exit); err != nil {
+		return -1, err
+	}
+	if exit.Error != "" {
+		return exit.Code, fmt.Errorf("exec: %s", exit.Error)
+	}
+	return exit.Code, nil
+}
+
+// parseExecSpec parses name=command [args...] as given to -exec.
+func parseExecSpec(spec string) (string, []string, error) {
+	name, command, ok := strings.Cut(spec, "=")
+	argv := strings.Fields(command)
+	if !ok || name == "" || len(argv) == 0 {
+		return "", nil, fmt.Errorf("bad exec spec %q, want name=command [args...]", spec)
+	}
+	return name, argv, nil
+}
+
+// execCommand runs the exec command with args, returning the remote
+// command's exit code.
+func execCommand(args []string, logger *slog.Logger) (int, error) {
+	fs := newFlagSet("exec", "[flags] <[host:]port> <command>")
+	dialOpts := clientFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return -1, err
+	}
+	if fs.NArg() != 2 {
+		return -1, usageError(fs, "exec needs a server and a command")
+	}
+	opts, err := dialOpts()
+	if err != nil {
+		return -1, err
+	}
+	m, err := DialMux(context.Background(), "tcp", hostPort(fs.Arg(0), "localhost"), append(opts, WithLogger(logger))...)
+	if err != nil {
+		return -1, err
+	}
+	defer m.Close()
+	return RunCommand(m, fs.Arg(1), os.Stdin, os.Stdout, os.Stderr)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func Test_Executor(t *testing.T) {
+	client := NewKeyPair()
+	e := &Executor{
+		Commands: map[string][]string{
+			"cat":     {"cat"},
+			"fail":    {"sh", "-c", "echo out; echo oops >&2; exit 3"},
+			"missing": {"/nonexistent/command"},
+		},
+		Authorize: AuthorizedKeys{*client.pub: true}.Check,
+	}
+	s := NewServer(NewKeyPair())
+	s.Handler = e
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	t.Run("stdin", func(t *testing.T) {
+		m, err := DialMux(context.Background(), "tcp", addr, WithKeyPair(client))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		var stdout, stderr bytes.Buffer
+		code, err := RunCommand(m, "cat", strings.NewReader("hello"), &stdout, &stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != 0 {
+			t.Errorf("Got code %d, want 0", code)
+		}
+		if got := stdout.String(); got != "hello" {
+			t.Errorf("Got stdout %q, want %q", got, "hello")
+		}
+	})
+
+	t.Run("exit code", func(t *testing.T) {
+		m, err := DialMux(context.Background(), "tcp", addr, WithKeyPair(client))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		var stdout, stderr bytes.Buffer
+		code, err := RunCommand(m, "fail", nil, &stdout, &stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != 3 {
+			t.Errorf("Got code %d, want 3", code)
+		}
+		if got := stdout.String(); got != "out\n" {
+			t.Errorf("Got stdout %q, want %q", got, "out\n")
+		}
+		if got := stderr.String(); got != "oops\n" {
+			t.Errorf("Got stderr %q, want %q", got, "oops\n")
+		}
+	})
+
+	t.Run("start failure", func(t *testing.T) {
+		m, err := DialMux(context.Background(), "tcp", addr, WithKeyPair(client))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		if _, err := RunCommand(m, "missing", nil, nil, nil); err == nil {
+			t.Fatal("Expected an error")
+		}
+		var stdout bytes.Buffer
+		code, err := RunCommand(m, "cat", strings.NewReader("next"), &stdout, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != 0 || stdout.String() != "next" {
+			t.Errorf("Got code %d stdout %q, want 0 and %q", code, stdout.String(), "next")
+		}
+	})
+
+	t.Run("unknown command", func(t *testing.T) {
+		m, err := DialMux(context.Background(), "tcp", addr, WithKeyPair(client))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		if _, err := RunCommand(m, "rm", nil, nil, nil); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		m, err := DialMux(context.Background(), "tcp", addr, WithKeyPair(NewKeyPair()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		_, err = RunCommand(m, "cat", nil, nil, nil)
+		if err == nil || !strings.Contains(err.Error(), ErrUnauthorizedKey.Error()) {
+			t.Errorf("Got %v, want %v", err, ErrUnauthorizedKey)
+		}
+	})
+}
+
+func Test_Executor_noAuthorize(t *testing.T) {
+	e := &Executor{Commands: map[string][]string{"cat": {"cat"}}}
+	s := NewServer(NewKeyPair())
+	s.Handler = e
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	m, err := DialMux(context.Background(), "tcp", addr, WithKeyPair(NewKeyPair()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if _, err := RunCommand(m, "cat", nil, nil, nil); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func Test_parseExecSpec(t *testing.T) {
+	name, argv, err := parseExecSpec("deploy=/usr/bin/make -C /srv deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "deploy" || strings.Join(argv, " ") != "/usr/bin/make -C /srv deploy" {
+		t.Errorf("Got %q %q", name, argv)
+	}
+	for _, spec := range []string{"deploy", "=make", "deploy="} {
+		if _, _, err := parseExecSpec(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
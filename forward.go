@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Port forwarding runs over a MuxSession. Each forwarded connection is a
+// stream that starts with a header saying what it's for:
+//
+//	dial      the client asks the server to connect to Addr
+//	listen    the client asks the server to listen on Addr, and keeps the
+//	          stream open for as long as the listener should stay open
+//	forwarded the server has accepted a connection on the listener at Addr
+//
+// The receiver of a dial or listen request replies with a header of its own
+// before any data is sent. A header is a uint16 length followed by JSON.
+
+const (
+	forwardDial      = "dial"
+	forwardListen    = "listen"
+	forwardForwarded = "forwarded"
+)
+
+type forwardRequest struct {
+	Op   string `json:"op"`
+	Addr string `json:"addr"`
+}
+
+type forwardReply struct {
+	Addr  string `json:"addr,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func writeHeader(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) > 0xffff {
+		return errors.New("header too large")
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	_, err = w.Write(buf)
+	return err
+}
+
+func readHeader(r io.Reader, v interface{}) error {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Forwarder is a Handler for the server side of port forwarding. It makes
+// outbound connections and opens listeners on behalf of its clients.
+type Forwarder struct {
+	// Authorize is called with the client's public key before any request.
+	// Returning an error refuses the request. If nil, every request is
+	// refused, so that a Forwarder is never an open proxy by accident.
+	Authorize func(peer *[keySize]byte) error
+
+	// AllowDial, if set, is called before connecting to addr for a client.
+	// Returning an error refuses the request.
+	AllowDial func(sess Session, addr string) error
+
+	// AllowListen, if set, is called before listening on addr for a client.
+	// Returning an error refuses the request.
+	AllowListen func(sess Session, addr string) error
+
+	// Logger, if set, receives diagnostics about forwarded connections.
+	Logger *slog.Logger
+}
+
+// ServeSession implements Handler.
+func (f *Forwarder) ServeSession(c *Conn) error {
+	sess := c.Session()
+	return MuxHandler(func(m *MuxSession) error {
+		for {
+			st, err := m.AcceptStream()
+			if err != nil {
+				return err
+			}
+			go f.serveStream(sess, m, st)
+		}
+	}).ServeSession(c)
+}
+
+func (f *Forwarder) serveStream(sess Session, m *MuxSession, st *Stream) {
+	log := orDiscard(f.Logger).With("session", sess.ID, "stream", st.ID())
+	var req forwardRequest
+	if err := readHeader(st, &req); err != nil {
+		log.Warn("bad forward request", "err", err)
+		st.Close()
+		return
+	}
+	if err := f.authorize(&sess.Peer); err != nil {
+		log.Info("forward refused", "op", req.Op, "addr", req.Addr, "err", err)
+		writeHeader(st, forwardReply{Error: err.Error()})
+		st.Close()
+		return
+	}
+	switch req.Op {
+	case forwardDial:
+		f.dial(sess, st, req.Addr, log)
+	case forwardListen:
+		f.listen(sess, m, st, req.Addr, log)
+	default:
+		writeHeader(st, forwardReply{Error: fmt.Sprintf("unknown op %q", req.Op)})
+		st.Close()
+	}
+}
+
+func (f *Forwarder) authorize(peer *[keySize]byte) error {
+	if f.Authorize == nil {
+		return ErrUnauthorizedKey
+	}
+	return f.Authorize(peer)
+}
+
+func (f *Forwarder) dial(sess Session, st *Stream, addr string, log *slog.Logger) {
+	var conn net.Conn
+	err := allow(f.AllowDial, sess, addr)
+	if err == nil {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		log.Info("forward refused", "addr", addr, "err", err)
+		writeHeader(st, forwardReply{Error: err.Error()})
+		st.Close()
+		return
+	}
+	log.Debug("forwarding", "addr", addr)
+	if err := writeHeader(st, forwardReply{Addr: conn.RemoteAddr().String()}); err != nil {
+		conn.Close()
+		st.Close()
+		return
+	}
+	splice(st, conn)
+}
+
+func (f *Forwarder) listen(sess Session, m *MuxSession, st *Stream, addr string, log *slog.Logger) {
+	var l net.Listener
+	err := allow(f.AllowListen, sess, addr)
+	if err == nil {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		log.Info("listen refused", "addr", addr, "err", err)
+		writeHeader(st, forwardReply{Error: err.Error()})
+		st.Close()
+		return
+	}
+	log.Info("listening", "addr", l.Addr())
+	if err := writeHeader(st, forwardReply{Addr: l.Addr().String()}); err != nil {
+		l.Close()
+		st.Close()
+		return
+	}
+
+	// The listener stays open until the client closes the stream or the
+	// session ends.
+	go func() {
+		io.Copy(io.Discard, st)
+		l.Close()
+		st.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			fst, err := m.OpenStream()
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if err := writeHeader(fst, forwardRequest{Op: forwardForwarded, Addr: addr}); err != nil {
+				conn.Close()
+				fst.Close()
+				return
+			}
+			splice(fst, conn)
+		}()
+	}
+}
+
+func allow(check func(Session, string) error, sess Session, addr string) error {
+	if check == nil {
+		return nil
+	}
+	return check(sess, addr)
+}
+
+// splice copies data both ways between a and b until both directions are
+// done, then closes them. An error in either direction closes both.
+func splice(a, b io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	cp := func(dst, src io.ReadWriteCloser) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err != nil {
+			a.Close()
+			b.Close()
+			return
+		}
+		closeWrite(dst)
+	}
+	wg.Add(2)
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+// Tunnel is the client side of port forwarding over a MuxSession.
+type Tunnel struct {
+	m *MuxSession
+
+	mu      sync.Mutex
+	remotes map[string]string
+}
+
+// NewTunnel starts forwarding over m, which must be connected to a server
+// whose Handler is a Forwarder.
+func NewTunnel(m *MuxSession) *Tunnel {
+	t := &Tunnel{m: m, remotes: make(map[string]string)}
+	go t.acceptForwarded()
+	return t
+}
+
+// Dial connects to addr from the server, returning a stream to it.
+func (t *Tunnel) Dial(addr string) (*Stream, error) {
+	st, _, err := t.request(forwardDial, addr)
+	return st, err
+}
+
+// ForwardLocal accepts connections on l and connects each one to target
+// from the server, like ssh -L. It returns when l is closed.
+func (t *Tunnel) ForwardLocal(l net.Listener, target string) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			st, err := t.Dial(target)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			splice(st, conn)
+		}()
+	}
+}
+
+// ForwardRemote asks the server to listen on addr and connects each
+// connection it accepts to target from here, like ssh -R. It returns the
+// address the server is listening on, and forwards until the session ends.
+func (t *Tunnel) ForwardRemote(addr, target string) (string, error) {
+	t.mu.Lock()
+	t.remotes[addr] = target
+	t.mu.Unlock()
+	st, bound, err := t.request(forwardListen, addr)
+	if err != nil {
+		t.mu.Lock()
+		delete(t.remotes, addr)
+		t.mu.Unlock()
+		return "", err
+	}
+	// Keep the stream open for as long as the listener should stay open.
+	go io.Copy(io.Discard, st)
+	return bound, nil
+}
+
+// Close ends the session and all forwarded connections.
+func (t *Tunnel) Close() error {
+	return t.m.Close()
+}
+
+// request opens a stream and makes a request of the server, returning the
+// address in the server's reply.
+func (t *Tunnel) request(op, addr string) (*Stream, string, error) {
+	st, err := t.m.OpenStream()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := writeHeader(st, forwardRequest{Op: op, Addr: addr}); err != nil {
+		st.Close()
+		return nil, "", err
+	}
+	var reply forwardReply
+	if err := readHeader(st, &reply); err != nil {
+		st.Close()
+		return nil, "", err
+	}
+	if reply.Error != "" {
+		st.Close()
+		return nil, "", fmt.Errorf("server refused %s %s: %s", op, addr, reply.Error)
+	}
+	return st, reply.Addr, nil
+}
+
+func (t *Tunnel) acceptForwarded() {
+	for {
+		st, err := t.m.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			var req forwardRequest
+			if err := readHeader(st, &req); err != nil || req.Op != forwardForwarded {
+				st.Close()
+				return
+			}
+			t.mu.Lock()
+			target, ok := t.remotes[req.Addr]
+			t.mu.Unlock()
+			if !ok {
+				st.Close()
+				return
+			}
+			conn, err := net.Dial("tcp", target)
+			if err != nil {
+				st.Close()
+				return
+			}
+			splice(st, conn)
+		}()
+	}
+}
+
+// parseForwardSpec parses [bind:]port:host:hostport as used by ssh -L and
+// -R, returning the address to listen on and the target address. The bind
+// address defaults to localhost.
+func parseForwardSpec(spec string) (listen, target string, err error) {
+	parts := strings.Split(spec, ":")
+	switch len(parts) {
+	case 3:
+		return "localhost:" + parts[0], parts[1] + ":" + parts[2], nil
+	case 4:
+		return parts[0] + ":" + parts[1], parts[2] + ":" + parts[3], nil
+	}
+	return "", "", fmt.Errorf("invalid forward %q, want [bind:]port:host:hostport", spec)
+}
+
+// stringList is a flag that may be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// forwardCommand runs the forward command with args.
+func forwardCommand(args []string, logger *slog.Logger) error {
+	var local, remote stringList
+	fs := newFlagSet("forward", "[-L spec]... [-R spec]... [flags] <[host:]port>")
+	fs.Var(&local, "L", "Forward a local port to a target reached from the server: [bind:]port:host:hostport")
+	fs.Var(&remote, "R", "Forward a port on the server to a target reached from here: [bind:]port:host:hostport")
+	dialOpts := clientFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || len(local)+len(remote) == 0 {
+		return usageError(fs, "forward needs a server and at least one -L or -R")
+	}
+
+	opts, err := dialOpts()
+	if err != nil {
+		return err
+	}
+	opts = append(opts, WithLogger(logger))
+
+	m, err := DialMux(context.Background(), "tcp", hostPort(fs.Arg(0), "localhost"), opts...)
+	if err != nil {
+		return err
+	}
+	t := NewTunnel(m)
+	defer t.Close()
+
+	for _, spec := range local {
+		addr, target, err := parseForwardSpec(spec)
+		if err != nil {
+			return err
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		logger.Info("forwarding local", "addr", l.Addr(), "target", target)
+		go t.ForwardLocal(l, target)
+	}
+	for _, spec := range remote {
+		addr, target, err := parseForwardSpec(spec)
+		if err != nil {
+			return err
+		}
+		bound, err := t.ForwardRemote(addr, target)
+		if err != nil {
+			return err
+		}
+		logger.Info("forwarding remote", "addr", bound, "target", target)
+	}
+
+	<-m.Done()
+	return errors.New("session with server ended")
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEchoTarget starts a plain TCP server that echoes each connection.
+func newEchoTarget(t *testing.T) (addr string, closer func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// allowAny authorizes every client.
+func allowAny(peer *[keySize]byte) error {
+	return nil
+}
+
+// dialTunnel returns a Tunnel to the forwarding server at addr.
+func dialTunnel(t *testing.T, addr string, opts ...DialOption) *Tunnel {
+	m, err := DialMux(context.Background(), "tcp", addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewTunnel(m)
+}
+
+// echoConn writes msg to conn, closes it for writing and checks that msg
+// comes back.
+func echoConn(t *testing.T, conn net.Conn, msg string) {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != msg {
+		t.Errorf("Got %q, want %q", got, msg)
+	}
+}
+
+func Test_Tunnel_ForwardLocal(t *testing.T) {
+	target, closeTarget := newEchoTarget(t)
+	defer closeTarget()
+	s := NewServer(NewKeyPair())
+	s.Handler = &Forwarder{Authorize: allowAny}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	tun := dialTunnel(t, addr)
+	defer tun.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go tun.ForwardLocal(l, target)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		echoConn(t, conn, "hello local")
+		conn.Close()
+	}
+}
+
+func Test_Tunnel_ForwardRemote(t *testing.T) {
+	target, closeTarget := newEchoTarget(t)
+	defer closeTarget()
+	s := NewServer(NewKeyPair())
+	s.Handler = &Forwarder{Authorize: allowAny}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	tun := dialTunnel(t, addr)
+	defer tun.Close()
+
+	remote, err := tun.ForwardRemote("127.0.0.1:0", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoConn(t, conn, "hello remote")
+}
+
+func Test_Tunnel_refused(t *testing.T) {
+	target, closeTarget := newEchoTarget(t)
+	defer closeTarget()
+	s := NewServer(NewKeyPair())
+	s.Handler = &Forwarder{
+		Authorize: allowAny,
+		AllowDial: func(sess Session, addr string) error {
+			return errors.New("not allowed")
+		},
+		AllowListen: func(sess Session, addr string) error {
+			return errors.New("not allowed")
+		},
+	}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	tun := dialTunnel(t, addr)
+	defer tun.Close()
+
+	if _, err := tun.Dial(target); err == nil {
+		t.Errorf("Want dial to be refused")
+	}
+	if _, err := tun.ForwardRemote("127.0.0.1:0", target); err == nil {
+		t.Errorf("Want listen to be refused")
+	}
+}
+
+func Test_Tunnel_unauthorized(t *testing.T) {
+	target, closeTarget := newEchoTarget(t)
+	defer closeTarget()
+	s := NewServer(NewKeyPair())
+	s.Handler = &Forwarder{}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	tun := dialTunnel(t, addr)
+	defer tun.Close()
+
+	if _, err := tun.Dial(target); err == nil || !strings.Contains(err.Error(), ErrUnauthorizedKey.Error()) {
+		t.Errorf("Got %v, want %v", err, ErrUnauthorizedKey)
+	}
+	if _, err := tun.ForwardRemote("127.0.0.1:0", target); err == nil {
+		t.Errorf("Want listen to be refused")
+	}
+}
+
+func Test_forwardCommand(t *testing.T) {
+	target, closeTarget := newEchoTarget(t)
+	defer closeTarget()
+
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := NewKeyPair()
+	keyPath := filepath.Join(dir, "client.key")
+	if err := WriteKeyPair(keyPath, client); err != nil {
+		t.Fatal(err)
+	}
+
+	// Forward mode as serve runs it, except the test can end the session.
+	s := NewServer(NewKeyPair())
+	s.OnHandshake = AuthorizedKeys{*client.pub: true}.Check
+	f := &Forwarder{Authorize: s.OnHandshake}
+	stop := make(chan struct{})
+	s.Handler = HandlerFunc(func(c *Conn) error {
+		go func() {
+			<-stop
+			c.Close()
+		}()
+		return f.ServeSession(c)
+	})
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	// Find a free port for the local end of the forward.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := l.Addr().String()
+	l.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- forwardCommand([]string{
+			"-key", keyPath,
+			"-server-key", fmt.Sprintf("%x", s.keyPair.pub[:]),
+			"-L", local + ":" + target,
+			addr,
+		}, orDiscard(nil))
+	}()
+
+	// Wait for forward to start listening.
+	var conn net.Conn
+	for tries := 0; ; tries++ {
+		if conn, err = net.Dial("tcp", local); err == nil {
+			break
+		}
+		if tries == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	echoConn(t, conn, "hello forward")
+	conn.Close()
+
+	close(stop)
+	select {
+	case err := <-errc:
+		if err == nil || !strings.Contains(err.Error(), "session with server ended") {
+			t.Errorf("Got %v, want the session to end", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Want forward to return when the session ends")
+	}
+}
+
+func Test_parseForwardSpec(t *testing.T) {
+	for _, tt := range []struct {
+		spec, listen, target string
+	}{
+		{"8000:db:5432", "localhost:8000", "db:5432"},
+		{"0.0.0.0:8000:db:5432", "0.0.0.0:8000", "db:5432"},
+		{"8000:db", "", ""},
+	} {
+		listen, target, err := parseForwardSpec(tt.spec)
+		if listen != tt.listen || target != tt.target {
+			t.Errorf("parseForwardSpec(%q) got %q, %q, want %q, %q", tt.spec, listen, target, tt.listen, tt.target)
+		}
+		if (err != nil) != (tt.listen == "") {
+			t.Errorf("parseForwardSpec(%q) got error %v", tt.spec, err)
+		}
+	}
+}
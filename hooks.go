@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hooks are callbacks for events in the life of a connection, used by Server
+// and Client. Any of them may be nil. They're called from the connection's
+// goroutine, so a slow hook delays that connection only.
+type Hooks struct {
+	// OnHandshake is called with the peer's public key once the key exchange
+	// completes. Returning an error rejects the peer and closes the
+	// connection.
+	OnHandshake func(peer *[keySize]byte) error
+
+	// OnSessionStart is called once the peer has been accepted.
+	OnSessionStart func(s Session)
+
+	// OnSessionEnd is called when the session is over, with the error that
+	// ended it, if any.
+	OnSessionEnd func(stats SessionStats, err error)
+
+	// OnFrameError is called when a message from the peer is malformed or
+	// fails to decrypt.
+	OnFrameError func(err error)
+}
+
+// Session identifies an authenticated connection.
+type Session struct {
+	// ID is unique among the sessions of a Server. It's zero for clients.
+	ID uint64
+
+	// RemoteAddr is the address of the peer, if known.
+	RemoteAddr net.Addr
+
+	// Peer is the peer's public key.
+	Peer [keySize]byte
+
+	// Start is when the session began.
+	Start time.Time
+}
+
+// SessionStats describes a session that has ended.
+type SessionStats struct {
+	Session
+
+	// Duration is how long the session lasted.
+	Duration time.Duration
+
+	// FramesIn and BytesIn count the messages received from the peer and
+	// their plaintext size.
+	FramesIn, BytesIn uint64
+
+	// FramesOut and BytesOut count the messages sent to the peer and their
+	// plaintext size.
+	FramesOut, BytesOut uint64
+}
+
+// callHandshake calls OnHandshake, if set.
+func (h *Hooks) callHandshake(peer *[keySize]byte) error {
+	if h.OnHandshake == nil {
+		return nil
+	}
+	return h.OnHandshake(peer)
+}
+
+// callSessionStart calls OnSessionStart, if set.
+func (h *Hooks) callSessionStart(s Session) {
+	if h.OnSessionStart != nil {
+		h.OnSessionStart(s)
+	}
+}
+
+// callSessionEnd calls OnSessionEnd, if set.
+func (h *Hooks) callSessionEnd(stats SessionStats, err error) {
+	if h.OnSessionEnd != nil {
+		h.OnSessionEnd(stats, err)
+	}
+}
+
+// callFrameError calls OnFrameError if err is a FrameError.
+func (h *Hooks) callFrameError(err error) {
+	var fe *FrameError
+	if h.OnFrameError != nil && errors.As(err, &fe) {
+		h.OnFrameError(err)
+	}
+}
+
+// sessionCounter is a Metrics that counts a single session's traffic and
+// passes every measurement on to another Metrics.
+type sessionCounter struct {
+	Metrics
+	session                                Session
+	framesIn, bytesIn, framesOut, bytesOut uint64
+}
+
+// Add implements Metrics.
+func (c *sessionCounter) Add(name string, delta float64, labels ...string) {
+	if len(labels) == 2 && labels[0] == "direction" {
+		in := labels[1] == "in"
+		switch {
+		case name == metricFrames && in:
+			atomic.AddUint64(&c.framesIn, uint64(delta))
+		case name == metricFrames:
+			atomic.AddUint64(&c.framesOut, uint64(delta))
+		case name == metricBytes && in:
+			atomic.AddUint64(&c.bytesIn, uint64(delta))
+		case name == metricBytes:
+			atomic.AddUint64(&c.bytesOut, uint64(delta))
+		}
+	}
+	c.Metrics.Add(name, delta, labels...)
+}
+
+// stats returns the session's statistics as of now.
+func (c *sessionCounter) stats() SessionStats {
+	return SessionStats{
+		Session:   c.session,
+		Duration:  time.Since(c.session.Start),
+		FramesIn:  atomic.LoadUint64(&c.framesIn),
+		BytesIn:   atomic.LoadUint64(&c.bytesIn),
+		FramesOut: atomic.LoadUint64(&c.framesOut),
+		BytesOut:  atomic.LoadUint64(&c.bytesOut),
+	}
+}
+
+// clientConn is the secure connection returned by Client.SecureConn. It runs
+// the client's hooks, and reads in the background so that control messages
+// from the server are handled even while the caller isn't reading.
+type clientConn struct {
+	r       *messageReader
+	w       *SecureWriter
+	pinger  *pinger
+	conn    io.Closer
+	hooks   *Hooks
+	counter *sessionCounter
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+// Read implements io.Reader, reporting malformed messages to OnFrameError.
+// If buf is too small for the next message, the rest is returned by the
+// following Reads.
+func (c *clientConn) Read(buf []byte) (int, error) {
+	n, err := c.r.Read(buf)
+	if err != nil {
+		c.hooks.callFrameError(err)
+		c.setErr(err)
+	}
+	return n, err
+}
+
+// Write implements io.Writer, sending buf as one message.
+func (c *clientConn) Write(buf []byte) (int, error) {
+	if _, err := c.w.Write(buf); err != nil {
+		c.setErr(err)
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// CloseWrite tells the server that no more data will be written, if the
+// underlying connection supports it.
+func (c *clientConn) CloseWrite() error {
+	return closeWrite(c.conn)
+}
+
+// Ping sends a ping to the server and waits for the reply.
+func (c *clientConn) Ping(ctx context.Context) error {
+	return c.pinger.ping(ctx, c.r)
+}
+
+// pending reports whether data from the server has arrived but not been read.
+func (c *clientConn) pending() bool {
+	return c.r.pending()
+}
+
+// Close closes the connection and ends the session. The session's error is
+// the first error seen by Read or Write, other than io.EOF.
+func (c *clientConn) Close() error {
+	c.r.close(ErrClientClosed)
+	err := c.conn.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.hooks.callSessionEnd(c.counter.stats(), c.err)
+	}
+	return err
+}
+
+func (c *clientConn) setErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil && err != io.EOF {
+		c.err = err
+	}
+}
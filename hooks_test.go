@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_Server_Hooks(t *testing.T) {
+	var peer *[keySize]byte
+	var started Session
+	ended := make(chan SessionStats, 1)
+
+	s := NewServer(NewKeyPair())
+	s.OnHandshake = func(p *[keySize]byte) error {
+		peer = p
+		return nil
+	}
+	s.OnSessionStart = func(sess Session) {
+		started = sess
+	}
+	s.OnSessionEnd = func(stats SessionStats, err error) {
+		ended <- stats
+	}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	conn, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	conn.Read(make([]byte, 5))
+
+	stats := <-ended
+	if peer == nil || *peer != started.Peer {
+		t.Errorf("Want OnHandshake and OnSessionStart to see the same peer")
+	}
+	if started.ID != 1 || started.RemoteAddr == nil {
+		t.Errorf("Got %+v, want session ID and address", started)
+	}
+	if stats.FramesIn != 1 || stats.BytesIn != 5 || stats.FramesOut != 1 || stats.BytesOut != 5 {
+		t.Errorf("Got %+v, want one 5 byte message each way", stats)
+	}
+}
+
+func Test_Server_OnHandshake_reject(t *testing.T) {
+	rejected := errors.New("not on the list")
+	handshakeErrs := make(chan error, 1)
+
+	s := NewServer(NewKeyPair())
+	s.OnHandshake = func(p *[keySize]byte) error {
+		return rejected
+	}
+	s.OnSessionStart = func(sess Session) {
+		t.Errorf("Want rejected client not to start a session")
+	}
+	s.OnHandshakeError = func(addr net.Addr, err error) {
+		handshakeErrs <- err
+	}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	conn, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := <-handshakeErrs; err != rejected {
+		t.Errorf("Got %v, want %v", err, rejected)
+	}
+	if _, err := conn.Read(make([]byte, 5)); err == nil {
+		t.Errorf("Want connection to be closed")
+	}
+}
+
+func Test_Client_Hooks(t *testing.T) {
+	kp := newFakeKeyPair("a", "b")
+	commonKey := kp.CommonKey()
+
+	var frameErr error
+	var stats SessionStats
+	var endErr error
+	c := Client{keyPair: kp, commonKey: commonKey, serverKey: kp.pub}
+	c.OnFrameError = func(err error) {
+		frameErr = err
+	}
+	c.OnSessionEnd = func(s SessionStats, err error) {
+		stats, endErr = s, err
+	}
+
+	// One good message, then garbage.
+	buf := &bytes.Buffer{}
+	NewSecureWriter(buf, kp.priv, kp.pub).Write([]byte("hi"))
+	buf.Write([]byte{0, 0, 0, 0, 0, 0, 0, 30})
+	buf.Write(make([]byte, 30))
+
+	rwc := struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{buf, io.Discard, io.NopCloser(nil)}
+	sc := c.SecureConn(rwc)
+
+	out := make([]byte, 10)
+	if _, err := sc.Read(out); err != nil {
+		t.Fatalf("Read got error %s", err)
+	}
+	if _, err := sc.Read(out); err == nil {
+		t.Fatalf("Want error reading garbage")
+	}
+	sc.Close()
+
+	if frameErr == nil {
+		t.Errorf("Want OnFrameError to be called")
+	}
+	if endErr != frameErr {
+		t.Errorf("Got session error %v, want %v", endErr, frameErr)
+	}
+	if stats.FramesIn != 1 || stats.BytesIn != 2 || stats.Peer != *kp.pub {
+		t.Errorf("Got %+v, want one 2 byte message from the peer", stats)
+	}
+}
+
+func Test_clientConn_Ping(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go Serve(l)
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The server answers pings while waiting for a message.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := conn.(Pinger).Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then hangs up after echoing it.
+	conn.Write([]byte("hi"))
+	conn.Read(make([]byte, 2))
+	if err := conn.(Pinger).Ping(ctx); err == nil {
+		t.Errorf("Want an error once the server hangs up")
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 
 	"golang.org/x/crypto/nacl/box"
 )
@@ -18,74 +20,153 @@ const maxMessageSize = uint64(32 * 1024)
 // transmitted after encryption, incoming to SecureReader.
 const maxWrittenMessageSize = maxMessageSize + box.Overhead + nonceSize + 8 // uint64 header
 
+// FrameError is returned by SecureReader when a message is malformed or can't
+// be decrypted, as opposed to when the underlying Reader fails.
+type FrameError struct {
+	Err error
+}
+
+func (e *FrameError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// controlFlag is set in a message's header when the message is a control
+// message, such as a ping, rather than data. Control messages are handled by
+// the connection and never returned by Read.
+const controlFlag = uint64(1) << 63
+
+// Control message types. The plaintext of a control message is its type.
+const (
+	controlPing byte = 1
+	controlPong byte = 2
+)
+
 // SecureReader implements io.Reader and uses a key to decrypt messages from
 // the underlying Reader. It expects the data to be in the form defined by
 // SecureWriter.
 type SecureReader struct {
 	r   io.Reader
 	key *[32]byte
+
+	// Logger, if set, receives diagnostics about each message.
+	Logger *slog.Logger
+
+	// Metrics, if set, counts messages, bytes and decryption failures.
+	Metrics Metrics
+
+	// control, if set, is called with the type of each control message, or
+	// zero if the message is malformed. Returning an error stops the Read
+	// with that error.
+	control func(typ byte) error
 }
 
 // Read implements io.Reader. Expects that data read from the reader has been
 // encrypted. If out is not big enough to hold the decrypted message, a partial
 // message is written and an error is returned.
 func (r SecureReader) Read(out []byte) (int, error) {
+	for {
+		res, control, err := r.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if control {
+			if r.control != nil {
+				var typ byte
+				if len(res) == 1 {
+					typ = res[0]
+				}
+				if err := r.control(typ); err != nil {
+					return 0, err
+				}
+			}
+			continue
+		}
+
+		// Copy the result for output.
+		co := copy(out, res)
+		if co < len(res) {
+			return co, &FrameError{fmt.Errorf("failed to write into the output buffer. Wrote %d, needed %d", co, len(res))}
+		}
+		return co, nil
+	}
+}
+
+// readMessage reads and decrypts the next message, reporting whether it's a
+// control message.
+func (r SecureReader) readMessage() ([]byte, bool, error) {
+	log := orDiscard(r.Logger)
+
 	// Read the header to find out how big the message is.
 	var size uint64
 	err := binary.Read(r.r, binary.BigEndian, &size)
 	if err != nil {
-		return 0, err
+		return nil, false, err
 	}
-	debugf("Read: %d byte message\n", size)
+	control := size&controlFlag != 0
+	size &^= controlFlag
+	log.Debug("reading message", "size", size, "control", control)
 
 	if size > maxWrittenMessageSize {
-		return 0, fmt.Errorf("message is too large. Got %d bytes, max: %d", size, maxWrittenMessageSize)
+		return nil, false, &FrameError{fmt.Errorf("message is too large. Got %d bytes, max: %d", size, maxWrittenMessageSize)}
 	}
 
 	// This buffer holds the encrypted message.
 	buf := make([]byte, size)
 
 	// Read everything into the buffer.
-	c, err := io.ReadFull(r.r, buf)
-	if err != nil {
-		return 0, err
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, false, err
 	}
-	debugf("Read: %d bytes\n%s\n", c, hex.Dump(buf))
 
 	// Get the Nonce from the buffer.
 	nonce, err := NonceFrom(buf)
 	if err != nil {
-		return 0, err
+		return nil, false, &FrameError{err}
 	}
-	debugf("Read: nonce\n%s\n", hex.Dump(nonce[:]))
 
 	// The message is the rest of the buffer after the nonce.
 	var msg = buf[len(nonce):]
 
-	debugf("Read: msg\n%s\n", hex.Dump(msg))
-
 	// Decrypt the message.
 	res, ok := box.OpenAfterPrecomputation(nil, msg, nonce, r.key)
 	if !ok {
-		return 0, errors.New("decryption failed")
+		log.Warn("decryption failed", "size", size)
+		orNop(r.Metrics).Add(metricDecryptionFailures, 1)
+		return nil, false, &FrameError{errors.New("decryption failed")}
 	}
-	debugf("Read: result\n%s\n", hex.Dump(res))
-
-	// Copy the result for output.
-	co := copy(out, res)
-	if co < len(res) {
-		return co, fmt.Errorf("failed to write into the output buffer. Wrote %d, needed %d", co, len(res))
+	if control {
+		return res, true, nil
 	}
-	return co, nil
+	metrics := orNop(r.Metrics)
+	metrics.Add(metricFrames, 1, "direction", "in")
+	metrics.Add(metricBytes, float64(len(res)), "direction", "in")
+	if tracing(log) {
+		log.Log(context.Background(), LevelTrace, "decrypted message", "nonce", hex.EncodeToString(nonce[:]), "plaintext", hex.Dump(res))
+	}
+	return res, false, nil
 }
 
 // SecureWriter implements io.Writer and encrypts data with a key before
 // writing to the underlying writer. The encrypted data has a uint64 header
 // indicating how long the encrypted message is, followed by the encrypted
 // message. The encrypted message is a 24 byte nonce followed by the message.
+//
+// Each message is passed to the underlying writer in a single Write, so a
+// net.Conn may be shared with other goroutines sending control messages.
 type SecureWriter struct {
 	w   io.Writer
 	key *[32]byte
+
+	// Logger, if set, receives diagnostics about each message.
+	Logger *slog.Logger
+
+	// Metrics, if set, counts messages and bytes.
+	Metrics Metrics
 }
 
 // Write implements io.Writer.
@@ -93,29 +174,42 @@ func (w SecureWriter) Write(buf []byte) (int, error) {
 	if uint64(len(buf)) > maxMessageSize {
 		return 0, fmt.Errorf("input is too large. Got %d bytes, max: %d", len(buf), maxMessageSize)
 	}
+	n, err := w.writeMessage(buf, 0)
+	if err == nil {
+		metrics := orNop(w.Metrics)
+		metrics.Add(metricFrames, 1, "direction", "out")
+		metrics.Add(metricBytes, float64(len(buf)), "direction", "out")
+	}
+	return n, err
+}
+
+// writeControl sends a control message of the given type.
+func (w SecureWriter) writeControl(typ byte) error {
+	_, err := w.writeMessage([]byte{typ}, controlFlag)
+	return err
+}
 
+// writeMessage encrypts buf and writes it with flags set in the header. It
+// returns the size of the header and the message.
+func (w SecureWriter) writeMessage(buf []byte, flags uint64) (int, error) {
 	// Create a nonce.
+	log := orDiscard(w.Logger)
 	nonce, err := NewNonce()
 	if err != nil {
 		return 0, err
 	}
-	debugf("Write: nonce\n%s\n", hex.Dump(nonce[:]))
-
-	// Encrypt the message with the nonce prefix.
-	sealed := box.SealAfterPrecomputation(nonce[:], buf, nonce, w.key)
-
-	debugf("Write: sealed %d bytes\n%s\n", len(sealed), hex.Dump(sealed))
-
-	// Write a fixed header indicating how long the message is.
-	header := uint64(len(sealed))
-	headerSize := binary.Size(header)
-	if err := binary.Write(w.w, binary.BigEndian, header); err != nil {
-		return headerSize, err
+	if flags == 0 && tracing(log) {
+		log.Log(context.Background(), LevelTrace, "encrypting message", "nonce", hex.EncodeToString(nonce[:]), "plaintext", hex.Dump(buf))
 	}
 
-	// Write the message.
-	messageSize, err := w.w.Write(sealed)
+	// Encrypt the message with the nonce prefix, leaving room for a fixed
+	// header indicating how long the message is.
+	const headerSize = 8
+	out := make([]byte, headerSize, headerSize+nonceSize+len(buf)+box.Overhead)
+	out = append(out, nonce[:]...)
+	out = box.SealAfterPrecomputation(out, buf, nonce, w.key)
+	binary.BigEndian.PutUint64(out, uint64(len(out)-headerSize)|flags)
+	log.Debug("writing message", "size", len(out)-headerSize, "control", flags != 0)
 
-	// Return the size of the header and the message.
-	return headerSize + messageSize, err
+	return w.w.Write(out)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"io"
 	"testing"
@@ -9,7 +10,7 @@ import (
 func Test_SecureWriter_Read_fails(t *testing.T) {
 	key := &[32]byte{}
 	r, w := io.Pipe()
-	sr := SecureReader{r, key}
+	sr := SecureReader{r: r, key: key}
 
 	in := make([]byte, 100)
 	binary.BigEndian.PutUint64(in, 30)
@@ -32,7 +33,7 @@ func Test_SecureWriter_Read_fails(t *testing.T) {
 
 func Test_SecureWriter_Write(t *testing.T) {
 	r, w := io.Pipe()
-	sw := SecureWriter{w, &[32]byte{}}
+	sw := SecureWriter{w: w, key: &[32]byte{}}
 
 	var readBytes int
 	var out = make([]byte, maxMessageSize+1024)
@@ -68,7 +69,7 @@ func Test_SecureWriter_Write_TooLong(t *testing.T) {
 	buf := [maxMessageSize + 1]byte{}
 
 	_, w := io.Pipe()
-	sw := SecureWriter{w, key}
+	sw := SecureWriter{w: w, key: key}
 
 	c, err := sw.Write(buf[:])
 	if nil == err {
@@ -85,8 +86,8 @@ func Test_Secure_ReadWrite(t *testing.T) {
 	buf := [4]byte{'a', 'b', 'c', 'd'}
 
 	r, w := io.Pipe()
-	sr := SecureReader{r, key}
-	sw := SecureWriter{w, key}
+	sr := SecureReader{r: r, key: key}
+	sw := SecureWriter{w: w, key: key}
 
 	var out = make([]byte, 1024)
 	var readBytes = -1
@@ -109,3 +110,28 @@ func Test_Secure_ReadWrite(t *testing.T) {
 		t.Errorf("Got %s, want %s", out, want)
 	}
 }
+
+func Test_SecureReader_control(t *testing.T) {
+	key := &[32]byte{}
+	var buf bytes.Buffer
+	sw := SecureWriter{w: &buf, key: key}
+	sw.writeControl(controlPing)
+	sw.Write([]byte("data"))
+
+	var got []byte
+	sr := SecureReader{r: &buf, key: key, control: func(typ byte) error {
+		got = append(got, typ)
+		return nil
+	}}
+	out := make([]byte, 10)
+	n, err := sr.Read(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out[:n]) != "data" {
+		t.Errorf("Got %q, want data", out[:n])
+	}
+	if len(got) != 1 || got[0] != controlPing {
+		t.Errorf("Got %v, want a ping", got)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrDeadPeer is returned by reads on a connection that was closed because
+// the peer stopped answering keepalive pings.
+var ErrDeadPeer = errors.New("peer stopped responding to pings")
+
+// pinger handles control messages on a connection. It answers the peer's
+// pings, and sends pings of its own.
+type pinger struct {
+	w *SecureWriter
+
+	mu   sync.Mutex
+	pong chan struct{}
+}
+
+func newPinger(w *SecureWriter) *pinger {
+	return &pinger{w: w, pong: make(chan struct{})}
+}
+
+// control is the SecureReader's control message handler. Unknown control
+// messages are ignored.
+func (p *pinger) control(typ byte) error {
+	switch typ {
+	case controlPing:
+		p.w.writeControl(controlPong)
+	case controlPong:
+		// Wake everyone waiting; any reply shows the peer is alive.
+		p.mu.Lock()
+		close(p.pong)
+		p.pong = make(chan struct{})
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// ping sends a ping and waits for the reply, which arrives through mr.
+func (p *pinger) ping(ctx context.Context, mr *messageReader) error {
+	p.mu.Lock()
+	pong := p.pong
+	p.mu.Unlock()
+	if err := p.w.writeControl(controlPing); err != nil {
+		return err
+	}
+	select {
+	case <-pong:
+		return nil
+	case <-mr.done:
+		return mr.error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// keepAlive pings the peer every interval until mr stops reading. If a reply
+// takes longer than timeout, reads fail with ErrDeadPeer and conn is closed.
+// A zero timeout means the same as interval.
+func keepAlive(p *pinger, mr *messageReader, conn io.Closer, interval, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = interval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-mr.done:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := p.ping(ctx, mr)
+		cancel()
+		if err == context.DeadlineExceeded {
+			mr.close(ErrDeadPeer)
+			conn.Close()
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_keepAlive_client(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// A server that completes the handshake and then goes silent.
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		NewServer(NewKeyPair()).handshake(conn, "127.0.0.1")
+		io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := Dial(l.Addr().String(), WithKeepAlive(10*time.Millisecond, 20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	errs := make(chan error)
+	go func() {
+		_, err := conn.Read(make([]byte, 10))
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if err != ErrDeadPeer {
+			t.Errorf("Got %v, want %v", err, ErrDeadPeer)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want the dead server to be detected")
+	}
+}
+
+func Test_keepAlive_server(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.KeepAlive = 10 * time.Millisecond
+	s.KeepAliveTimeout = 20 * time.Millisecond
+	ended := make(chan error, 1)
+	s.OnSessionEnd = func(stats SessionStats, err error) {
+		ended <- err
+	}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	// A client that completes the handshake and then ignores the server.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := NewClient(NewKeyPair()).Handshake(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-ended:
+		if err != ErrDeadPeer {
+			t.Errorf("Got %v, want %v", err, ErrDeadPeer)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want the dead client to be detected")
+	}
+}
+
+func Test_keepAlive_alive(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = StreamEchoHandler
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	conn, err := Dial(addr, WithKeepAlive(5*time.Millisecond, 50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Idle for many intervals; the server's replies keep the connection up.
+	time.Sleep(100 * time.Millisecond)
+	echo(t, conn, "hello")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// ErrUnauthorizedKey is returned when a client's public key isn't in the
+// server's AuthorizedKeys.
+var ErrUnauthorizedKey = errors.New("client key is not authorized")
+
+// NewKeyPairFromPrivate returns the KeyPair for an existing private key.
+func NewKeyPairFromPrivate(priv *[keySize]byte) *KeyPair {
+	pub := new([keySize]byte)
+	curve25519.ScalarBaseMult(pub, priv)
+	return &KeyPair{pub: pub, priv: priv}
+}
+
+// PublicKey returns the public half of the key pair.
+func (kp *KeyPair) PublicKey() *[keySize]byte {
+	return kp.pub
+}
+
+// ParseKey decodes a hex encoded key.
+func ParseKey(s string) (*[keySize]byte, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %s", err)
+	}
+	if len(b) != keySize {
+		return nil, fmt.Errorf("invalid key: got %d bytes, want %d", len(b), keySize)
+	}
+	var k [keySize]byte
+	copy(k[:], b)
+	return &k, nil
+}
+
+// ReadKeyPair reads a key pair from a file holding the hex encoded private
+// key, as written by WriteKeyPair.
+func ReadKeyPair(path string) (*KeyPair, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := ParseKey(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return NewKeyPairFromPrivate(priv), nil
+}
+
+// WriteKeyPair writes the private key to a new file that only the owner can
+// read.
+func WriteKeyPair(path string, kp *KeyPair) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(kp.priv[:])); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// AuthorizedKeys is a set of client public keys. Its Check method can be
+// used as a Server's OnHandshake hook.
+type AuthorizedKeys map[[keySize]byte]bool
+
+// ParseAuthorizedKeys reads hex encoded public keys, one per line. Blank
+// lines and lines starting with # are ignored, as is anything after the key
+// on a line, which may be used for a comment.
+func ParseAuthorizedKeys(r io.Reader) (AuthorizedKeys, error) {
+	keys := make(AuthorizedKeys)
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		k, err := ParseKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		keys[*k] = true
+	}
+	return keys, s.Err()
+}
+
+// ReadAuthorizedKeys reads a file in the format of ParseAuthorizedKeys.
+func ReadAuthorizedKeys(path string) (AuthorizedKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys, err := ParseAuthorizedKeys(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return keys, nil
+}
+
+// Check returns ErrUnauthorizedKey if peer isn't in the set.
+func (a AuthorizedKeys) Check(peer *[keySize]byte) error {
+	if !a[*peer] {
+		return ErrUnauthorizedKey
+	}
+	return nil
+}
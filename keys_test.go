@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_NewKeyPairFromPrivate(t *testing.T) {
+	kp := NewKeyPair()
+	got := NewKeyPairFromPrivate(kp.priv)
+	if *got.pub != *kp.pub {
+		t.Errorf("Got %x, want %x", got.pub, kp.pub)
+	}
+}
+
+func Test_WriteKeyPair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key")
+
+	kp := NewKeyPair()
+	if err := WriteKeyPair(path, kp); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteKeyPair(path, kp); err == nil {
+		t.Errorf("Want an error overwriting a key")
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Got mode %s, want -rw-------", fi.Mode())
+	}
+
+	got, err := ReadKeyPair(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got.pub != *kp.pub || *got.priv != *kp.priv {
+		t.Errorf("Want the same key pair back")
+	}
+}
+
+func Test_ParseKey(t *testing.T) {
+	kp := NewKeyPair()
+	k, err := ParseKey(hex.EncodeToString(kp.pub[:]) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *k != *kp.pub {
+		t.Errorf("Got %x, want %x", k, kp.pub)
+	}
+	for _, s := range []string{"", "zz", "abcd"} {
+		if _, err := ParseKey(s); err == nil {
+			t.Errorf("ParseKey(%q) want error", s)
+		}
+	}
+}
+
+func Test_AuthorizedKeys(t *testing.T) {
+	a, b := NewKeyPair(), NewKeyPair()
+	input := "# ops team\n\n" + hex.EncodeToString(a.pub[:]) + " alice\n"
+	keys, err := ParseAuthorizedKeys(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Check(a.pub); err != nil {
+		t.Errorf("Got %v, want nil", err)
+	}
+	if err := keys.Check(b.pub); err != ErrUnauthorizedKey {
+		t.Errorf("Got %v, want %v", err, ErrUnauthorizedKey)
+	}
+
+	if _, err := ParseAuthorizedKeys(strings.NewReader("nope\n")); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("Got %v, want an error on line 1", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// LimitPolicy decides what the Server does with a new client when it is
+// already serving the maximum number of sessions.
+type LimitPolicy int
+
+const (
+	// LimitReject closes the new connection immediately.
+	LimitReject LimitPolicy = iota
+
+	// LimitQueue holds new connections until a session ends. Queued clients
+	// are dropped if the listener is closed. The per-IP limit always
+	// rejects, so that a single address can't stall everyone else in the
+	// queue.
+	LimitQueue
+)
+
+// ServerStats is a snapshot of the Server's session counters.
+type ServerStats struct {
+	// ActiveSessions is the number of clients currently being served.
+	ActiveSessions int
+
+	// QueuedSessions is the total number of clients that had to wait for a
+	// session to end before being served.
+	QueuedSessions uint64
+
+	// RejectedSessions is the total number of clients that were turned away
+	// because a limit was reached.
+	RejectedSessions uint64
+}
+
+// sessionLimiter counts active sessions, globally and by source IP.
+type sessionLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	active   int
+	perIP    map[string]int
+	queued   uint64
+	rejected uint64
+}
+
+// acquire reserves a session for ip, returning false if the client should be
+// rejected. A max of zero means no limit. A queued client gives up once stop
+// is closed and wake has been called.
+func (l *sessionLimiter) acquire(ip string, max, maxPerIP int, policy LimitPolicy, stop <-chan struct{}) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+
+	if maxPerIP > 0 && l.perIP[ip] >= maxPerIP {
+		l.rejected++
+		return false
+	}
+	if max > 0 && l.active >= max {
+		if policy != LimitQueue {
+			l.rejected++
+			return false
+		}
+		l.queued++
+		for l.active >= max {
+			select {
+			case <-stop:
+				l.rejected++
+				return false
+			default:
+			}
+			l.cond.Wait()
+		}
+	}
+
+	l.active++
+	l.perIP[ip]++
+	return true
+}
+
+// wake wakes every queued client, so that they notice their stop channel.
+func (l *sessionLimiter) wake() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	l.cond.Broadcast()
+}
+
+// init sets up the limiter. Must be called with mu held.
+func (l *sessionLimiter) init() {
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mu)
+		l.perIP = make(map[string]int)
+	}
+}
+
+// release ends a session for ip that was reserved with acquire.
+func (l *sessionLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+	l.cond.Signal()
+}
+
+// stats returns a snapshot of the counters.
+func (l *sessionLimiter) stats() ServerStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return ServerStats{
+		ActiveSessions:   l.active,
+		QueuedSessions:   l.queued,
+		RejectedSessions: l.rejected,
+	}
+}
+
+// remoteIP returns the host part of addr, or the whole address if it has no
+// port, as with unix sockets.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_sessionLimiter_acquire(t *testing.T) {
+	var l sessionLimiter
+
+	if !l.acquire("a", 2, 1, LimitReject, nil) {
+		t.Fatalf("Want first session to be accepted")
+	}
+	if l.acquire("a", 2, 1, LimitReject, nil) {
+		t.Errorf("Want second session from the same IP to be rejected")
+	}
+	if !l.acquire("b", 2, 1, LimitReject, nil) {
+		t.Errorf("Want session from another IP to be accepted")
+	}
+	if l.acquire("c", 2, 1, LimitReject, nil) {
+		t.Errorf("Want session over the global limit to be rejected")
+	}
+
+	l.release("a")
+	if !l.acquire("c", 2, 1, LimitReject, nil) {
+		t.Errorf("Want session to be accepted after a release")
+	}
+
+	want := ServerStats{ActiveSessions: 2, RejectedSessions: 2}
+	if got := l.stats(); got != want {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
+
+func Test_sessionLimiter_acquire_queue(t *testing.T) {
+	var l sessionLimiter
+	l.acquire("a", 1, 0, LimitQueue, nil)
+
+	done := make(chan bool)
+	go func() {
+		done <- l.acquire("b", 1, 0, LimitQueue, nil)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Want session to wait for a free slot")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	l.release("a")
+	if ok := <-done; !ok {
+		t.Fatalf("Want queued session to be accepted")
+	}
+
+	want := ServerStats{ActiveSessions: 1, QueuedSessions: 1}
+	if got := l.stats(); got != want {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
+
+func Test_sessionLimiter_acquire_stop(t *testing.T) {
+	var l sessionLimiter
+	l.acquire("a", 1, 0, LimitQueue, nil)
+
+	stop := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		done <- l.acquire("b", 1, 0, LimitQueue, stop)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	l.wake()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Errorf("Want queued session to be rejected once stopped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Want queued session to stop waiting")
+	}
+}
+
+func Test_Server_Serve_queueClosed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(NewKeyPair())
+	s.MaxSessions = 1
+	s.LimitPolicy = LimitQueue
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(l)
+	}()
+
+	c1, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	// The second client waits for the first to finish, until the listener
+	// is closed.
+	queued := make(chan error, 1)
+	go func() {
+		c2, err := Dial(l.Addr().String())
+		if err == nil {
+			c2.Close()
+		}
+		queued <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	l.Close()
+
+	for _, ch := range []chan error{served, queued} {
+		select {
+		case err := <-ch:
+			if err == nil {
+				t.Errorf("Want an error")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Want closing the listener to stop the server and its queue")
+		}
+	}
+}
+
+func Test_Server_Serve_maxSessions(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.MaxSessions = 1
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	// The first client holds the only session.
+	c1, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	// The second is closed before the handshake.
+	if _, err := Dial(addr); err == nil {
+		t.Errorf("Want second client to be rejected")
+	}
+
+	if got := s.Stats(); got.ActiveSessions != 1 || got.RejectedSessions != 1 {
+		t.Errorf("Got %+v, want 1 active and 1 rejected session", got)
+	}
+}
+
+func Test_remoteIP(t *testing.T) {
+	tcp := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	if got := remoteIP(tcp); got != "10.0.0.1" {
+		t.Errorf("Got %s, want 10.0.0.1", got)
+	}
+	unix := &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}
+	if got := remoteIP(unix); got != "/tmp/sock" {
+		t.Errorf("Got %s, want /tmp/sock", got)
+	}
+}
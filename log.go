@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// LevelTrace is the most verbose log level. Messages at this level include
+// plaintext and key material, so it must only be enabled deliberately, and
+// never in production.
+const LevelTrace = slog.LevelDebug - 4
+
+// ParseLevel returns the log level with the given name: error, warn, info,
+// debug or unsafe-trace.
+func ParseLevel(name string) (slog.Level, error) {
+	if strings.EqualFold(name, "unsafe-trace") {
+		return LevelTrace, nil
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+	return l, nil
+}
+
+// NewLogHandlerOptions returns handler options that log at level and name
+// LevelTrace as UNSAFE-TRACE.
+func NewLogHandlerOptions(level slog.Leveler) *slog.HandlerOptions {
+	return &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 {
+				if l, ok := a.Value.Any().(slog.Level); ok && l <= LevelTrace {
+					a.Value = slog.StringValue("UNSAFE-TRACE")
+				}
+			}
+			return a
+		},
+	}
+}
+
+// tracing reports whether log will record plaintext and keys.
+func tracing(log *slog.Logger) bool {
+	return log.Enabled(context.Background(), LevelTrace)
+}
+
+// orDiscard returns log, or a Logger that discards everything if log is nil.
+func orDiscard(log *slog.Logger) *slog.Logger {
+	if log == nil {
+		return discardLogger
+	}
+	return log
+}
+
+var discardLogger = slog.New(discardHandler{})
+
+// discardHandler is a slog.Handler that is never enabled.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func Test_ParseLevel(t *testing.T) {
+	tests := []struct {
+		name string
+		want slog.Level
+	}{
+		{"error", slog.LevelError},
+		{"WARN", slog.LevelWarn},
+		{"info", slog.LevelInfo},
+		{"debug", slog.LevelDebug},
+		{"unsafe-trace", LevelTrace},
+	}
+	for _, test := range tests {
+		got, err := ParseLevel(test.name)
+		if err != nil {
+			t.Errorf("%s: got error %s", test.name, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+	if _, err := ParseLevel("trace"); err == nil {
+		t.Errorf("Want error for an unknown level")
+	}
+}
+
+// logSecureMessage sends a message through a SecureWriter and SecureReader
+// that both log to the returned buffer at level.
+func logSecureMessage(t *testing.T, level slog.Level, msg string) string {
+	out := &bytes.Buffer{}
+	log := slog.New(slog.NewTextHandler(out, NewLogHandlerOptions(level)))
+	key := &[32]byte{'k'}
+
+	buf := &bytes.Buffer{}
+	sw := SecureWriter{w: buf, key: key, Logger: log}
+	sr := SecureReader{r: buf, key: key, Logger: log}
+	if _, err := sw.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sr.Read(make([]byte, 1024)); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func Test_SecureReadWriter_logging(t *testing.T) {
+	secret := "attack at dawn"
+	hexSecret := "61 74 74 61 63 6b" // "attack"
+
+	out := logSecureMessage(t, slog.LevelDebug, secret)
+	if !strings.Contains(out, "writing message") || !strings.Contains(out, "reading message") {
+		t.Errorf("Want debug messages, got:\n%s", out)
+	}
+	if strings.Contains(out, secret) || strings.Contains(out, hexSecret) {
+		t.Errorf("Want no plaintext at debug level, got:\n%s", out)
+	}
+
+	out = logSecureMessage(t, LevelTrace, secret)
+	if !strings.Contains(out, hexSecret) {
+		t.Errorf("Want plaintext at trace level, got:\n%s", out)
+	}
+	if !strings.Contains(out, "level=UNSAFE-TRACE") {
+		t.Errorf("Want trace level to be named, got:\n%s", out)
+	}
+}
+
+func Test_orDiscard(t *testing.T) {
+	if orDiscard(nil) != discardLogger {
+		t.Errorf("Want discard logger for nil")
+	}
+	if tracing(discardLogger) {
+		t.Errorf("Want discard logger not to trace")
+	}
+}
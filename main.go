@@ -1,60 +1,184 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
+	"path/filepath"
+	"time"
 )
 
-// debugging enables debug message to STDOUT.
-var debugging = false
-
-// debugf is a Printf wrapper used to output helpful debugging output. It may
-// be used throughout this package for convenience.
-func debugf(msg string, v ...interface{}) {
-	if debugging == true {
-		fmt.Printf(msg, v...)
-	}
-}
-
 // NewSecureReader instantiates a new SecureReader
 func NewSecureReader(r io.Reader, priv, pub *[32]byte) io.Reader {
 	key := CommonKey(pub, priv)
-	return &SecureReader{r, key}
+	return &SecureReader{r: r, key: key}
 }
 
 // NewSecureWriter instantiates a new SecureWriter
 func NewSecureWriter(w io.Writer, priv, pub *[32]byte) io.Writer {
 	key := CommonKey(pub, priv)
-	return &SecureWriter{w, key}
+	return &SecureWriter{w: w, key: key}
+}
+
+// DialOption configures how Dial connects to a server.
+type DialOption func(*dialConfig)
+
+type dialConfig struct {
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
+	logger           *slog.Logger
+	hooks            Hooks
+	serverKey        *[keySize]byte
+	keepAlive        time.Duration
+	keepAliveTimeout time.Duration
+	keyPair          *KeyPair
+}
+
+// WithDialTimeout limits how long Dial waits for the network connection to
+// be established.
+func WithDialTimeout(d time.Duration) DialOption {
+	return func(c *dialConfig) {
+		c.dialTimeout = d
+	}
+}
+
+// WithHandshakeTimeout limits how long Dial waits for the key exchange to
+// complete once connected.
+func WithHandshakeTimeout(d time.Duration) DialOption {
+	return func(c *dialConfig) {
+		c.handshakeTimeout = d
+	}
+}
+
+// WithLogger sets the Logger used by the client.
+func WithLogger(l *slog.Logger) DialOption {
+	return func(c *dialConfig) {
+		c.logger = l
+	}
+}
+
+// WithHooks sets the callbacks run as the session progresses.
+func WithHooks(h Hooks) DialOption {
+	return func(c *dialConfig) {
+		c.hooks = h
+	}
+}
+
+// WithServerKey pins the server's public key. The handshake fails with
+// ErrUnexpectedKey if the server presents any other key.
+func WithServerKey(pub *[keySize]byte) DialOption {
+	return func(c *dialConfig) {
+		c.serverKey = pub
+	}
+}
+
+// WithKeyPair makes the client identify itself with kp, rather than a new
+// key pair for each connection, so that servers can authorize it.
+func WithKeyPair(kp *KeyPair) DialOption {
+	return func(c *dialConfig) {
+		c.keyPair = kp
+	}
+}
+
+// WithKeepAlive pings the server every interval. If the server doesn't reply
+// within timeout, the connection is closed and reads fail with ErrDeadPeer.
+func WithKeepAlive(interval, timeout time.Duration) DialOption {
+	return func(c *dialConfig) {
+		c.keepAlive = interval
+		c.keepAliveTimeout = timeout
+	}
 }
 
 // Dial generates a private/public key pair,
 // connects to the server, perform the handshake
 // and return a reader/writer.
-func Dial(addr string) (io.ReadWriteCloser, error) {
-	keyPair := NewKeyPair()
-	if keyPair == nil {
-		return nil, fmt.Errorf("failed to create a keys")
+func Dial(addr string, opts ...DialOption) (io.ReadWriteCloser, error) {
+	return DialContext(context.Background(), "tcp", addr, opts...)
+}
+
+// DialContext is like Dial but connects using the named network (tcp, tcp4,
+// tcp6 or unix). If the context is cancelled before the handshake completes,
+// the connection is closed and the context's error is returned.
+func DialContext(ctx context.Context, network, addr string, opts ...DialOption) (io.ReadWriteCloser, error) {
+	var cfg dialConfig
+	for _, opt := range opts {
+		opt(&cfg)
 	}
 
-	// Connect on the network.
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, err
+	keyPair := cfg.keyPair
+	if keyPair == nil {
+		keyPair = NewKeyPair()
+	}
+	if keyPair == nil {
+		return nil, fmt.Errorf("failed to create a keys")
 	}
 
 	// Initialize the client, perform handshake and return a secure
-	// connection to the server.
+	// connection to the server. If the server is under load it asks us to
+	// come back with a cookie, so allow for a second attempt.
 	c := NewClient(keyPair)
-	if err := c.Handshake(conn); err != nil {
-		return nil, err
+	c.Logger = cfg.logger
+	c.Hooks = cfg.hooks
+	c.expectedKey = cfg.serverKey
+	c.KeepAlive = cfg.keepAlive
+	c.KeepAliveTimeout = cfg.keepAliveTimeout
+	d := net.Dialer{Timeout: cfg.dialTimeout}
+	for attempt := 0; ; attempt++ {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		err = handshakeContext(ctx, conn, c, cfg.handshakeTimeout)
+		if err == nil {
+			return c.SecureConn(conn), nil
+		}
+		conn.Close()
+		if err != ErrCookieRequired || attempt > 0 {
+			return nil, err
+		}
 	}
-	return c.SecureConn(conn), nil
+}
 
+// handshakeContext runs the client handshake on conn, giving up when the
+// timeout expires or the context is done.
+func handshakeContext(ctx context.Context, conn net.Conn, c *Client, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// Interrupt the handshake by expiring the deadline if the context is
+	// cancelled.
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	err := c.Handshake(conn)
+	close(done)
+	<-stopped
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
 }
 
 // Serve starts a secure echo server on the given listener.
@@ -67,34 +191,69 @@ func Serve(l net.Listener) error {
 }
 
 func main() {
-	port := flag.Int("l", 0, "Listen mode. Specify port")
-	flag.Parse()
+	os.Exit(run(filepath.Base(os.Args[0]), os.Args[1:]))
+}
 
-	// Server mode
-	if *port != 0 {
-		l, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+// clientFlags adds flags for how to dial a server to fs. The returned
+// function gives the corresponding options once fs has been parsed.
+func clientFlags(fs *flag.FlagSet) func() ([]DialOption, error) {
+	loadConfig := configFlag(fs)
+	keyPath := fs.String("key", "", "File holding the client's private key, so the server can authorize it")
+	serverKey := fs.String("server-key", "", "Hex encoded public key the server must present")
+	return func() ([]DialOption, error) {
+		cfg, err := loadConfig()
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		defer l.Close()
-		log.Fatal(Serve(l))
+		overrideFlags(fs, map[string]func(){
+			"key":        func() { cfg.Key = *keyPath },
+			"server-key": func() { cfg.ServerKey = *serverKey },
+		})
+		if err := cfg.Validate(); err != nil {
+			return nil, err
+		}
+		return cfg.DialOptions()
 	}
+}
 
-	// Client mode
-	if len(os.Args) != 3 {
-		log.Fatalf("Usage: %s <port> <message>", os.Args[0])
-	}
-	conn, err := Dial(fmt.Sprintf("localhost:%s", os.Args[1]))
-	if err != nil {
-		log.Fatal(err)
-	}
-	if _, err := conn.Write([]byte(os.Args[2])); err != nil {
-		log.Fatal(err)
+// serverFlags adds flags for the server's config and keys to fs. The
+// returned function gives the Config once fs has been parsed, with any flags
+// given overriding the file.
+func serverFlags(fs *flag.FlagSet) func() (*Config, error) {
+	loadConfig := configFlag(fs)
+	keyPath := fs.String("key", "", "File holding the server's private key")
+	authorizedKeys := fs.String("authorized-keys", "", "File of client public keys allowed to connect")
+	return func() (*Config, error) {
+		cfg, err := loadConfig()
+		if err != nil {
+			return nil, err
+		}
+		overrideFlags(fs, map[string]func(){
+			"key":             func() { cfg.Key = *keyPath },
+			"authorized-keys": func() { cfg.AuthorizedKeys = *authorizedKeys },
+		})
+		return cfg, nil
 	}
-	buf := make([]byte, len(os.Args[2]))
-	n, err := conn.Read(buf)
-	if err != nil {
-		log.Fatal(err)
+}
+
+// configFlag adds the -config flag to fs. The returned function loads the
+// file once fs has been parsed, or returns an empty Config if none was given.
+func configFlag(fs *flag.FlagSet) func() (*Config, error) {
+	path := fs.String("config", "", "JSON config file. Flags override its settings")
+	return func() (*Config, error) {
+		if *path == "" {
+			return &Config{}, nil
+		}
+		return LoadConfig(*path)
 	}
-	fmt.Printf("%s\n", buf[:n])
+}
+
+// overrideFlags calls the function for each flag in fs that was given on the
+// command line.
+func overrideFlags(fs *flag.FlagSet, set map[string]func()) {
+	fs.Visit(func(f *flag.Flag) {
+		if fn, ok := set[f.Name]; ok {
+			fn()
+		}
+	})
 }
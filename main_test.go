@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
 )
 
 func TestReadWriterPing(t *testing.T) {
@@ -159,7 +166,7 @@ func TestSecureDial(t *testing.T) {
 			}
 			go func(c net.Conn) {
 				defer c.Close()
-				key := [32]byte{}
+				key, _, _ := box.GenerateKey(rand.Reader)
 				c.Write(key[:])
 				buf := make([]byte, 2048)
 				n, err := c.Read(buf)
@@ -184,3 +191,95 @@ func TestSecureDial(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	// Create a random listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Accept connections but never send a key.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	_, err = Dial(l.Addr().String(), WithHandshakeTimeout(10*time.Millisecond))
+	if err == nil {
+		t.Fatal("Want Dial to time out during the handshake")
+	}
+}
+
+func TestDialContextCancel(t *testing.T) {
+	// Create a random listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Accept connections but never send a key.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err = DialContext(ctx, "tcp", l.Addr().String())
+	if err != context.Canceled {
+		t.Fatalf("Got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDialContextUnix(t *testing.T) {
+	dir, err := os.MkdirTemp("", "nacl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Start the server
+	go Serve(l)
+
+	conn, err := DialContext(context.Background(), "unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected := "hello world\n"
+	if _, err := fmt.Fprint(conn, expected); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != expected {
+		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
+	}
+}
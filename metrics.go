@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Names of the metrics recorded by the Server.
+const (
+	metricConnectionsAccepted = "nacl_connections_accepted_total"
+	metricConnectionsRejected = "nacl_connections_rejected_total"
+	metricHandshakes          = "nacl_handshakes_total"
+	metricDecryptionFailures  = "nacl_decryption_failures_total"
+	metricFrames              = "nacl_frames_total"
+	metricBytes               = "nacl_bytes_total"
+	metricSessionDuration     = "nacl_session_duration_seconds"
+)
+
+// Metrics receives measurements from the Server. Labels are given as
+// alternating names and values. Implementations must be safe for concurrent
+// use.
+type Metrics interface {
+	// Add increments the counter called name by delta.
+	Add(name string, delta float64, labels ...string)
+
+	// Observe records value in the histogram called name.
+	Observe(name string, value float64, labels ...string)
+}
+
+// nopMetrics discards all measurements.
+type nopMetrics struct{}
+
+func (nopMetrics) Add(string, float64, ...string)     {}
+func (nopMetrics) Observe(string, float64, ...string) {}
+
+// orNop returns m, or a Metrics that discards everything if m is nil.
+func orNop(m Metrics) Metrics {
+	if m == nil {
+		return nopMetrics{}
+	}
+	return m
+}
+
+// errorReason returns a short label describing why a handshake failed.
+func errorReason(err error) string {
+	var ne net.Error
+	switch {
+	case err == ErrShortKey:
+		return "short_key"
+	case err == ErrInvalidKey:
+		return "invalid_key"
+	case err == ErrReflectedKey:
+		return "reflected_key"
+	case err == ErrInvalidCookie:
+		return "invalid_cookie"
+	case err == errCookieSent:
+		return "cookie_sent"
+	case err == ErrRateLimited:
+		return "rate_limited"
+	case err == io.EOF:
+		return "eof"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+// DefaultBuckets are the upper bounds of the histogram buckets used by
+// Registry, suitable for durations in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60, 300, 3600}
+
+// Registry is a Metrics that keeps everything in memory and can write it in
+// the Prometheus text exposition format.
+type Registry struct {
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// Add implements Metrics.
+func (r *Registry) Add(name string, delta float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	series, ok := r.counters[name]
+	if !ok {
+		series = make(map[string]float64)
+		r.counters[name] = series
+	}
+	series[formatLabels(labels)] += delta
+}
+
+// Observe implements Metrics.
+func (r *Registry) Observe(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	series, ok := r.histograms[name]
+	if !ok {
+		series = make(map[string]*histogram)
+		r.histograms[name] = series
+	}
+	key := formatLabels(labels)
+	h, ok := series[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(DefaultBuckets))}
+		series[key] = h
+	}
+	for i, le := range DefaultBuckets {
+		if value <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// WriteTo writes all metrics to w in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+	for _, name := range sortedKeys(r.counters) {
+		fmt.Fprintf(&b, "# TYPE %s counter\n", name)
+		series := r.counters[name]
+		for _, labels := range sortedKeys(series) {
+			fmt.Fprintf(&b, "%s%s %s\n", name, labels, formatValue(series[labels]))
+		}
+	}
+	for _, name := range sortedKeys(r.histograms) {
+		fmt.Fprintf(&b, "# TYPE %s histogram\n", name)
+		series := r.histograms[name]
+		for _, labels := range sortedKeys(series) {
+			h := series[labels]
+			for i, le := range DefaultBuckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", name, withLabel(labels, "le", formatValue(le)), h.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), h.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", name, labels, formatValue(h.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, labels, h.count)
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+// formatLabels formats alternating label names and values as {a="b",c="d"}.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", labels[i], strconv.Quote(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds a label to labels formatted by formatLabels.
+func withLabel(labels, name, value string) string {
+	pair := fmt.Sprintf("%s=%s", name, strconv.Quote(value))
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a map with string keys, in order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
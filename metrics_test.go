@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Registry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	r.Add("requests_total", 1)
+	r.Add("frames_total", 2, "direction", "in")
+	r.Add("frames_total", 3, "direction", "in")
+	r.Add("frames_total", 1, "direction", "out")
+	r.Observe("duration_seconds", 0.02)
+	r.Observe("duration_seconds", 2)
+
+	buf := &bytes.Buffer{}
+	if _, err := r.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+
+	for _, want := range []string{
+		"# TYPE frames_total counter\n",
+		"frames_total{direction=\"in\"} 5\n",
+		"frames_total{direction=\"out\"} 1\n",
+		"requests_total 1\n",
+		"# TYPE duration_seconds histogram\n",
+		"duration_seconds_bucket{le=\"0.01\"} 0\n",
+		"duration_seconds_bucket{le=\"0.05\"} 1\n",
+		"duration_seconds_bucket{le=\"5\"} 2\n",
+		"duration_seconds_bucket{le=\"+Inf\"} 2\n",
+		"duration_seconds_sum 2.02\n",
+		"duration_seconds_count 2\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Want output to contain %q, got:\n%s", want, got)
+		}
+	}
+}
+
+func Test_Registry_ServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.Add("requests_total", 1, "code", "200")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("Got content type %s, want text/plain", got)
+	}
+	if want := "requests_total{code=\"200\"} 1\n"; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("Want body to contain %q, got:\n%s", want, w.Body.String())
+	}
+}
+
+func Test_withLabel(t *testing.T) {
+	if got, want := withLabel("", "le", "1"), `{le="1"}`; got != want {
+		t.Errorf("Got %s, want %s", got, want)
+	}
+	if got, want := withLabel(`{a="b"}`, "le", "1"), `{a="b",le="1"}`; got != want {
+		t.Errorf("Got %s, want %s", got, want)
+	}
+}
+
+func Test_errorReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{ErrShortKey, "short_key"},
+		{ErrInvalidKey, "invalid_key"},
+		{ErrRateLimited, "rate_limited"},
+		{io.EOF, "eof"},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, "timeout"},
+		{io.ErrClosedPipe, "other"},
+	}
+	for _, test := range tests {
+		if got := errorReason(test.err); got != test.want {
+			t.Errorf("Got %s for %v, want %s", got, test.err, test.want)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func Test_Server_metrics(t *testing.T) {
+	r := NewRegistry()
+	s := NewServer(NewKeyPair())
+	s.Metrics = r
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	conn, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	conn.Read(make([]byte, 5))
+	conn.Close()
+
+	// Wait for the session to end.
+	var got string
+	for i := 0; i < 100 && !strings.Contains(got, "nacl_session_duration_seconds_count 1"); i++ {
+		time.Sleep(time.Millisecond)
+		buf := &bytes.Buffer{}
+		r.WriteTo(buf)
+		got = buf.String()
+	}
+	for _, want := range []string{
+		"nacl_connections_accepted_total 1\n",
+		"nacl_handshakes_total{result=\"success\"} 1\n",
+		"nacl_frames_total{direction=\"in\"} 1\n",
+		"nacl_bytes_total{direction=\"out\"} 5\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Want metrics to contain %q, got:\n%s", want, got)
+		}
+	}
+}
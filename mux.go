@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// A MuxSession carries many independent streams over one secure connection.
+// Each message on the connection is a frame: a one byte type, a four byte
+// stream ID and a payload. Streams opened by the client have odd IDs, and
+// those opened by the server even IDs, so both can open streams at once.
+//
+// Flow control is per stream. A sender may have at most muxWindowSize bytes
+// in flight until the receiver reads them and grants more with a window
+// frame, so a stream that isn't being read can't hold up the others.
+
+const (
+	muxOpen   byte = iota // open a new stream
+	muxData               // payload is stream data
+	muxWindow             // payload is a uint32 number of bytes the sender may send
+	muxClose              // sender won't write to the stream again
+	muxReset              // stream is aborted in both directions
+)
+
+const (
+	muxHeaderSize    = 5
+	maxMuxPayload    = int(maxMessageSize) - muxHeaderSize
+	muxWindowSize    = 256 * 1024
+	muxAcceptBacklog = 64
+)
+
+var (
+	// ErrMuxClosed is returned when using a MuxSession that has been closed.
+	ErrMuxClosed = errors.New("mux session closed")
+
+	// ErrStreamClosed is returned when using a Stream after Close.
+	ErrStreamClosed = errors.New("stream closed")
+
+	// ErrStreamReset is returned when the peer aborts a stream.
+	ErrStreamReset = errors.New("stream reset by peer")
+
+	errMuxProtocol = errors.New("mux protocol error")
+)
+
+// MuxSession multiplexes streams over a connection that preserves message
+// boundaries, such as a Conn or a connection from Dial.
+type MuxSession struct {
+	conn   io.ReadWriteCloser
+	wmu    sync.Mutex
+	accept chan *Stream
+	done   chan struct{}
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+}
+
+// NewMuxSession starts multiplexing streams over conn. The server and client
+// sides of a connection must pass different values for server.
+func NewMuxSession(conn io.ReadWriteCloser, server bool) *MuxSession {
+	m := &MuxSession{
+		conn:    conn,
+		accept:  make(chan *Stream, muxAcceptBacklog),
+		done:    make(chan struct{}),
+		streams: make(map[uint32]*Stream),
+		nextID:  1,
+	}
+	if server {
+		m.nextID = 2
+	}
+	go m.readLoop()
+	return m
+}
+
+// DialMux connects to a server whose Handler is a MuxHandler, returning the
+// multiplexed session.
+func DialMux(ctx context.Context, network, addr string, opts ...DialOption) (*MuxSession, error) {
+	conn, err := DialContext(ctx, network, addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewMuxSession(conn, false), nil
+}
+
+// MuxHandler is a Handler that multiplexes streams over each client's
+// session. The session is closed when the function returns.
+type MuxHandler func(m *MuxSession) error
+
+// ServeSession implements Handler.
+func (h MuxHandler) ServeSession(c *Conn) error {
+	m := NewMuxSession(c, true)
+	defer m.Close()
+	return h(m)
+}
+
+// OpenStream opens a new stream to the peer.
+func (m *MuxSession) OpenStream() (*Stream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	st := newStream(m, m.nextID)
+	m.streams[st.id] = st
+	m.nextID += 2
+	m.mu.Unlock()
+
+	if err := m.writeFrame(muxOpen, st.id, nil); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for the peer to open a stream.
+func (m *MuxSession) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-m.accept:
+		return st, nil
+	case <-m.done:
+		return nil, m.err
+	}
+}
+
+// Close closes the session, the underlying connection and all streams.
+func (m *MuxSession) Close() error {
+	m.shutdown(ErrMuxClosed)
+	return nil
+}
+
+// Done returns a channel that's closed when the session ends.
+func (m *MuxSession) Done() <-chan struct{} {
+	return m.done
+}
+
+// shutdown ends the session, failing all streams with err.
+func (m *MuxSession) shutdown(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	if err == io.EOF {
+		err = ErrMuxClosed
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = nil
+	m.mu.Unlock()
+
+	close(m.done)
+	m.conn.Close()
+	for _, st := range streams {
+		st.fail(err)
+	}
+}
+
+func (m *MuxSession) writeFrame(typ byte, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], id)
+	copy(frame[muxHeaderSize:], payload)
+
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	if _, err := m.conn.Write(frame); err != nil {
+		m.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+func (m *MuxSession) readLoop() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := m.conn.Read(buf)
+		if err != nil {
+			m.shutdown(err)
+			return
+		}
+		if n < muxHeaderSize {
+			m.shutdown(errMuxProtocol)
+			return
+		}
+		id := binary.BigEndian.Uint32(buf[1:])
+		if err := m.handleFrame(buf[0], id, buf[muxHeaderSize:n]); err != nil {
+			m.shutdown(err)
+			return
+		}
+	}
+}
+
+func (m *MuxSession) handleFrame(typ byte, id uint32, payload []byte) error {
+	m.mu.Lock()
+	if m.err != nil {
+		// The session is shut down, and its streams already failed.
+		m.mu.Unlock()
+		return nil
+	}
+	st := m.streams[id]
+	if typ == muxOpen {
+		// The peer must use its own IDs, and not reuse one.
+		if st != nil || id%2 == m.nextID%2 {
+			m.mu.Unlock()
+			return errMuxProtocol
+		}
+		st = newStream(m, id)
+		m.streams[id] = st
+	}
+	m.mu.Unlock()
+
+	if st == nil {
+		// The stream was already removed, so there's nobody to tell.
+		return nil
+	}
+
+	switch typ {
+	case muxOpen:
+		select {
+		case m.accept <- st:
+		default:
+			m.remove(id)
+			go m.writeFrame(muxReset, id, nil)
+		}
+	case muxData:
+		return st.push(payload)
+	case muxWindow:
+		if len(payload) != 4 {
+			return errMuxProtocol
+		}
+		st.grant(int(binary.BigEndian.Uint32(payload)))
+	case muxClose:
+		st.remoteClose()
+	case muxReset:
+		m.remove(id)
+		st.fail(ErrStreamReset)
+	default:
+		return errMuxProtocol
+	}
+	return nil
+}
+
+func (m *MuxSession) remove(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.streams, id)
+}
+
+// Stream is a bidirectional byte stream within a MuxSession.
+type Stream struct {
+	id uint32
+	m  *MuxSession
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	buf          bytes.Buffer
+	recvWindow   int // bytes the peer may send before we grant more
+	unacked      int // bytes read but not yet granted back
+	sendWindow   int // bytes we may send before the peer grants more
+	localClosed  bool
+	writeClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+func newStream(m *MuxSession, id uint32) *Stream {
+	st := &Stream{
+		id:         id,
+		m:          m,
+		recvWindow: muxWindowSize,
+		sendWindow: muxWindowSize,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// ID returns the stream's identifier within the session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read implements io.Reader. It returns io.EOF once the peer has closed the
+// stream and all data has been read.
+func (st *Stream) Read(buf []byte) (int, error) {
+	st.mu.Lock()
+	for st.buf.Len() == 0 && !st.remoteClosed && !st.localClosed && st.err == nil {
+		st.cond.Wait()
+	}
+	switch {
+	case st.localClosed:
+		st.mu.Unlock()
+		return 0, ErrStreamClosed
+	case st.buf.Len() == 0 && st.err != nil:
+		err := st.err
+		st.mu.Unlock()
+		return 0, err
+	case st.buf.Len() == 0:
+		st.mu.Unlock()
+		return 0, io.EOF
+	}
+	n, _ := st.buf.Read(buf)
+	grant := st.consume(n)
+	st.mu.Unlock()
+
+	if grant > 0 {
+		st.sendGrant(grant)
+	}
+	return n, nil
+}
+
+// consume records that n bytes were taken from the stream, returning how
+// many bytes to grant back to the peer, if any. Must be called with mu held.
+func (st *Stream) consume(n int) int {
+	st.unacked += n
+	if st.unacked < muxWindowSize/2 {
+		return 0
+	}
+	grant := st.unacked
+	st.unacked = 0
+	st.recvWindow += grant
+	return grant
+}
+
+func (st *Stream) sendGrant(n int) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n))
+	st.m.writeFrame(muxWindow, st.id, b[:])
+}
+
+// Write implements io.Writer. It blocks while the peer's window is full.
+func (st *Stream) Write(buf []byte) (int, error) {
+	var written int
+	for len(buf) > 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && !st.writeClosed && st.err == nil {
+			st.cond.Wait()
+		}
+		if st.writeClosed {
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		}
+		n := len(buf)
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > maxMuxPayload {
+			n = maxMuxPayload
+		}
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.m.writeFrame(muxData, st.id, buf[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		buf = buf[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer that no more data will be written. The stream
+// can still be read.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.writeClosed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.writeClosed = true
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	return st.m.writeFrame(muxClose, st.id, nil)
+}
+
+// Close closes the stream for writing and stops reading from it. Any data
+// the peer still sends is discarded.
+func (st *Stream) Close() error {
+	err := st.CloseWrite()
+	st.mu.Lock()
+	st.localClosed = true
+	st.buf.Reset()
+	done := st.remoteClosed || st.err != nil
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if done {
+		st.m.remove(st.id)
+	}
+	return err
+}
+
+// push adds data from the peer to the stream.
+func (st *Stream) push(data []byte) error {
+	st.mu.Lock()
+	if len(data) > st.recvWindow {
+		st.mu.Unlock()
+		return errMuxProtocol
+	}
+	st.recvWindow -= len(data)
+	if !st.localClosed {
+		st.buf.Write(data)
+		st.cond.Broadcast()
+		st.mu.Unlock()
+		return nil
+	}
+	// Nobody will read this, but the peer still needs the window back.
+	grant := st.consume(len(data))
+	st.mu.Unlock()
+	if grant > 0 {
+		go st.sendGrant(grant)
+	}
+	return nil
+}
+
+// grant allows n more bytes to be written.
+func (st *Stream) grant(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sendWindow += n
+	st.cond.Broadcast()
+}
+
+// remoteClose marks the stream as closed by the peer.
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if done {
+		st.m.remove(st.id)
+	}
+}
+
+// fail aborts the stream with err.
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+)
+
+// newMuxPair returns two ends of a multiplexed session over an in-memory
+// connection.
+func newMuxPair() (client, server *MuxSession) {
+	c, s := net.Pipe()
+	return NewMuxSession(c, false), NewMuxSession(s, true)
+}
+
+func Test_MuxSession_OpenStream(t *testing.T) {
+	client, server := newMuxPair()
+	defer client.Close()
+	defer server.Close()
+
+	// Streams may be opened from either side.
+	for _, pair := range []struct {
+		name         string
+		open, accept *MuxSession
+	}{
+		{"client", client, server},
+		{"server", server, client},
+	} {
+		st, err := pair.open.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			st.Write([]byte("hello from " + pair.name))
+			st.CloseWrite()
+		}()
+
+		peer, err := pair.accept.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peer.ID() != st.ID() {
+			t.Errorf("Got stream %d, want %d", peer.ID(), st.ID())
+		}
+		got, err := ioutil.ReadAll(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "hello from "+pair.name {
+			t.Errorf("Got %q", got)
+		}
+		st.Close()
+		peer.Close()
+	}
+}
+
+func Test_MuxSession_concurrentStreams(t *testing.T) {
+	client, server := newMuxPair()
+	defer client.Close()
+	defer server.Close()
+
+	// Echo every stream.
+	go func() {
+		for {
+			st, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st, err := client.OpenStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer st.Close()
+			msg := bytes.Repeat([]byte(fmt.Sprint(i)), 1000)
+			go func() {
+				st.Write(msg)
+				st.CloseWrite()
+			}()
+			got, err := ioutil.ReadAll(st)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, msg) {
+				errs <- fmt.Errorf("stream %d got %d bytes, want %d", st.ID(), len(got), len(msg))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func Test_Stream_flowControl(t *testing.T) {
+	client, server := newMuxPair()
+	defer client.Close()
+	defer server.Close()
+
+	slow, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slowPeer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill the window of a stream nobody reads.
+	written := make(chan int)
+	go func() {
+		n, _ := slow.Write(make([]byte, muxWindowSize*2))
+		written <- n
+	}()
+
+	// Other streams keep working.
+	fast, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fastPeer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(fastPeer, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case n := <-written:
+		t.Fatalf("Write of %d bytes finished without the peer reading", n)
+	default:
+	}
+
+	// Reading lets the blocked write finish.
+	go io.Copy(ioutil.Discard, slowPeer)
+	if n := <-written; n != muxWindowSize*2 {
+		t.Errorf("Got %d, want %d", n, muxWindowSize*2)
+	}
+}
+
+func Test_Stream_Close(t *testing.T) {
+	client, server := newMuxPair()
+	defer client.Close()
+	defer server.Close()
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st.Close()
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Got %v, want EOF", err)
+	}
+	if _, err := st.Write([]byte("x")); err != ErrStreamClosed {
+		t.Errorf("Got %v, want %v", err, ErrStreamClosed)
+	}
+
+	// The peer can still write; the data is dropped.
+	if _, err := peer.Write([]byte("late")); err != nil {
+		t.Errorf("Got %v, want nil", err)
+	}
+	peer.Close()
+}
+
+func Test_MuxSession_Close(t *testing.T) {
+	client, server := newMuxPair()
+	defer server.Close()
+
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Close()
+	if _, err := st.Read(make([]byte, 1)); err != ErrMuxClosed {
+		t.Errorf("Got %v, want %v", err, ErrMuxClosed)
+	}
+	if _, err := client.OpenStream(); err != ErrMuxClosed {
+		t.Errorf("Got %v, want %v", err, ErrMuxClosed)
+	}
+	<-server.Done()
+	if _, err := server.AcceptStream(); err != ErrMuxClosed {
+		t.Errorf("Got %v, want %v", err, ErrMuxClosed)
+	}
+
+	// Frames read just before the session closed are dropped.
+	if err := server.handleFrame(muxOpen, 1, nil); err != nil {
+		t.Errorf("Got %v, want no error", err)
+	}
+}
+
+func TestDialMux(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = MuxHandler(func(m *MuxSession) error {
+		for {
+			st, err := m.AcceptStream()
+			if err != nil {
+				return err
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	})
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	m, err := DialMux(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	for i := 0; i < 3; i++ {
+		st, err := m.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := bytes.Repeat([]byte("abc"), 20000)
+		go func() {
+			st.Write(msg)
+			st.CloseWrite()
+		}()
+		got, err := ioutil.ReadAll(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("Got %d bytes, want %d", len(got), len(msg))
+		}
+		st.Close()
+	}
+}
@@ -1,121 +1,461 @@
 package main
 
 import (
-	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Server is the secure echo server.
 type Server struct {
 	keyPair *KeyPair
+
+	// HandshakeTimeout limits how long a client has to complete the key
+	// exchange. Zero means no timeout.
+	HandshakeTimeout time.Duration
+
+	// IdleTimeout limits how long a read may wait for the client's next
+	// message. Zero means no timeout.
+	IdleTimeout time.Duration
+
+	// MaxSessionLifetime limits the total time a client may stay connected,
+	// including the handshake. Zero means no limit.
+	MaxSessionLifetime time.Duration
+
+	// KeepAlive is how often to ping each client. If a client doesn't reply
+	// within KeepAliveTimeout, its connection is closed and the handler's
+	// reads fail with ErrDeadPeer. Zero disables pings.
+	KeepAlive time.Duration
+
+	// KeepAliveTimeout limits how long to wait for a reply to a ping. Zero
+	// means the same as KeepAlive.
+	KeepAliveTimeout time.Duration
+
+	// MaxSessions limits how many clients are served at once. Zero means no
+	// limit.
+	MaxSessions int
+
+	// MaxSessionsPerIP limits how many clients from a single source IP are
+	// served at once. Zero means no limit.
+	MaxSessionsPerIP int
+
+	// LimitPolicy decides what happens to clients beyond MaxSessions.
+	LimitPolicy LimitPolicy
+
+	// CookieThreshold is the number of handshakes in progress above which
+	// the server answers new clients with a cookie that they must present on
+	// a new connection. This bounds the key agreement work an attacker can
+	// cause without a real address. Zero disables cookies.
+	CookieThreshold int
+
+	// HandshakeRate limits how often clients may start a handshake.
+	HandshakeRate RateLimit
+
+	// HandshakeRatePerIP limits how often clients from a single source IP
+	// may start a handshake.
+	HandshakeRatePerIP RateLimit
+
+	// FrameRate limits how many messages each client may send.
+	FrameRate RateLimit
+
+	// ByteRate limits how many bytes of messages each client may send. A
+	// Burst smaller than the largest message is raised to that size.
+	ByteRate RateLimit
+
+	// OnHandshakeError, if set, is called when the key exchange with a
+	// client fails. The connection is closed once it returns.
+	OnHandshakeError func(addr net.Addr, err error)
+
+	// Hooks are called as each client's session progresses.
+	Hooks
+
+	// Handler serves each client once the handshake is done. The default
+	// is EchoHandler.
+	Handler Handler
+
+	// Logger, if set, receives diagnostics about the server and each
+	// connection.
+	Logger *slog.Logger
+
+	// Metrics, if set, receives measurements about connections, handshakes
+	// and traffic.
+	Metrics Metrics
+
+	sessions        sessionLimiter
+	connID          uint64
+	cookies         cookieJar
+	handshaking     int64
+	handshakeBucket *tokenBucket
+	handshakeByIP   bucketMap
+	initOnce        sync.Once
 }
 
 // NewServer initializes a new Server with its own keys. The server will
 // perform a handshake with each client to exchange public keys.
 func NewServer(kp *KeyPair) *Server {
-	return &Server{kp}
+	return &Server{keyPair: kp}
 }
 
-// Serve starts an infinite loop waiting for client connections.
+// Serve starts an infinite loop waiting for client connections. Clients
+// queued for a session are dropped when it returns.
 func (s *Server) Serve(l net.Listener) error {
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		s.sessions.wake()
+	}()
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			s.debug("Failed to accept client: %s\n", err)
+			s.logger().Error("failed to accept client", "err", err)
 			return err
 		}
-		go func(conn net.Conn) {
-			defer conn.Close()
-			commonKey, err := s.handshake(conn)
-			if err != nil {
-				s.debug("Error performing handshake: %s\n", err)
+		s.metrics().Add(metricConnectionsAccepted, 1)
+		// Clients wait for a session here rather than in Accept, so that
+		// closing the listener still stops the server.
+		go func() {
+			ip := remoteIP(conn.RemoteAddr())
+			if !s.sessions.acquire(ip, s.MaxSessions, s.MaxSessionsPerIP, s.LimitPolicy, stop) {
+				s.logger().Warn("rejected client: too many sessions", "remote", conn.RemoteAddr())
+				s.metrics().Add(metricConnectionsRejected, 1, "reason", "max_sessions")
+				conn.Close()
+				return
 			}
-			if err := s.handle(conn, commonKey); err != nil {
-				s.debug("Error handling client: %s\n", err)
-			}
-		}(conn)
+			defer s.sessions.release(ip)
+			s.serveConn(conn)
+		}()
 	}
 }
 
-// handshake performs the key exchange with the client, returning the shared
-// key that can be used to communicate with that client only.
-func (s *Server) handshake(conn io.ReadWriter) (*[keySize]byte, error) {
-	s.debug("Performing key exchange...\n")
-	kp, err := s.keyPair.Exchange(conn)
+// Stats returns a snapshot of the server's session counters.
+func (s *Server) Stats() ServerStats {
+	return s.sessions.stats()
+}
+
+// serveConn performs the handshake with a single client and then handles it.
+// If the handshake fails the connection is closed without reaching handle.
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	id := atomic.AddUint64(&s.connID, 1)
+	log := s.logger().With("conn", id, "remote", conn.RemoteAddr())
+	log.Debug("accepted connection")
+
+	tc := &timeoutConn{Conn: conn, idle: s.IdleTimeout}
+	if s.MaxSessionLifetime > 0 {
+		tc.end = time.Now().Add(s.MaxSessionLifetime)
+	}
+
+	if err := s.allowHandshake(conn.RemoteAddr()); err != nil {
+		log.Warn("rejected client", "err", err)
+		s.metrics().Add(metricConnectionsRejected, 1, "reason", errorReason(err))
+		if s.OnHandshakeError != nil {
+			s.OnHandshakeError(conn.RemoteAddr(), err)
+		}
+		return
+	}
+
+	// The handshake gets its own deadline, capped by the session lifetime.
+	if s.HandshakeTimeout > 0 {
+		conn.SetDeadline(tc.deadline(s.HandshakeTimeout))
+	} else {
+		conn.SetDeadline(tc.end)
+	}
+	peer, err := s.handshake(conn, remoteIP(conn.RemoteAddr()))
+	if err == errCookieSent {
+		log.Debug("sent cookie")
+		s.metrics().Add(metricHandshakes, 1, "result", "retry", "reason", errorReason(err))
+		return
+	}
 	if err != nil {
-		return nil, err
+		log.Warn("handshake failed", "err", err)
+		s.metrics().Add(metricHandshakes, 1, "result", "failure", "reason", errorReason(err))
+		if s.OnHandshakeError != nil {
+			s.OnHandshakeError(conn.RemoteAddr(), err)
+		}
+		return
 	}
-	commonKey := kp.CommonKey()
-	return commonKey, nil
-}
+	if err := s.callHandshake(peer.pub); err != nil {
+		log.Warn("client rejected", "peer", Fingerprint(peer.pub), "err", err)
+		s.metrics().Add(metricHandshakes, 1, "result", "failure", "reason", "rejected")
+		if s.OnHandshakeError != nil {
+			s.OnHandshakeError(conn.RemoteAddr(), err)
+		}
+		return
+	}
+	conn.SetDeadline(tc.end)
+	s.metrics().Add(metricHandshakes, 1, "result", "success")
 
-// handle takes care of client/server behavior after the handshake.
-func (s *Server) handle(conn io.ReadWriter, commonKey *[keySize]byte) error {
-	// Setup encrypted reader/writer to communicate with the client.
-	sr := &SecureReader{conn, commonKey}
-	sw := &SecureWriter{conn, commonKey}
-
-	// Read decrypted data from the client.
-	s.debug("Reading...\n")
-	buf := make([]byte, maxMessageSize)
-	c, err := sr.Read(buf)
+	log = log.With("peer", Fingerprint(peer.pub))
+	log.Info("session started")
+	counter := &sessionCounter{
+		Metrics: s.metrics(),
+		session: Session{
+			ID:         id,
+			RemoteAddr: conn.RemoteAddr(),
+			Peer:       *peer.pub,
+			Start:      time.Now(),
+		},
+	}
+	s.callSessionStart(counter.session)
+
+	c := s.newConn(tc, peer.CommonKey(), log, counter)
+	err = s.handle(c)
+	c.Close()
+	s.callFrameError(err)
+	stats := counter.stats()
+	s.metrics().Observe(metricSessionDuration, stats.Duration.Seconds())
+	s.callSessionEnd(stats, err)
 	if err != nil {
-		return err
+		log.Info("session ended", "err", err)
+		return
 	}
-	s.debug("Read %d bytes: %s\n", c, buf[:c])
+	log.Info("session ended")
+}
 
-	// Write encrypted data back to the client.
-	s.debug("Writing...\n")
-	c, err = sw.Write(buf[:c])
+// handshake performs the key exchange with the client, returning a KeyPair
+// holding the client's public key and the server's private key. When the
+// server is under load, a client without a valid cookie for ip is sent one
+// and errCookieSent is returned.
+func (s *Server) handshake(conn io.ReadWriter, ip string) (*KeyPair, error) {
+	n := atomic.AddInt64(&s.handshaking, 1)
+	defer atomic.AddInt64(&s.handshaking, -1)
+	underLoad := s.CookieThreshold > 0 && n > int64(s.CookieThreshold)
+
+	// Normally the key is sent right away. Under load it's held back until
+	// the client has shown a cookie.
+	if !underLoad {
+		if err := s.keyPair.send(conn); err != nil {
+			return nil, err
+		}
+	}
+	kp, cookie, err := s.keyPair.recvHello(conn, true)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if cookie != nil && !s.cookies.valid(cookie, ip, time.Now()) {
+		return nil, ErrInvalidCookie
+	}
+	if underLoad {
+		if cookie == nil {
+			if err := sendCookie(conn, s.cookies.make(ip, time.Now())); err != nil {
+				return nil, err
+			}
+			return nil, errCookieSent
+		}
+		if err := s.keyPair.send(conn); err != nil {
+			return nil, err
+		}
 	}
-	s.debug("Wrote %d bytes\n", c)
+	return kp, nil
+}
 
+// allowHandshake returns ErrRateLimited if a handshake with addr would go
+// over the handshake rate limits.
+func (s *Server) allowHandshake(addr net.Addr) error {
+	s.initOnce.Do(func() {
+		if s.HandshakeRate.enabled() {
+			s.handshakeBucket = s.HandshakeRate.bucket()
+		}
+	})
+	now := time.Now()
+	if s.handshakeBucket != nil && !s.handshakeBucket.allow(now, 1) {
+		return ErrRateLimited
+	}
+	if s.HandshakeRatePerIP.enabled() && !s.handshakeByIP.allow(remoteIP(addr), s.HandshakeRatePerIP, now) {
+		return ErrRateLimited
+	}
 	return nil
 }
 
-func (s *Server) debug(str string, v ...interface{}) {
-	debugf("server: %s", fmt.Sprintf(str, v...))
+// limitReader applies the per-session rate limits to a SecureReader,
+// including its control messages.
+func (s *Server) limitReader(sr *SecureReader) io.Reader {
+	if !s.FrameRate.enabled() && !s.ByteRate.enabled() {
+		return sr
+	}
+	lr := &rateLimitedReader{r: sr}
+	if s.FrameRate.enabled() {
+		lr.frames = s.FrameRate.bucket()
+	}
+	if s.ByteRate.enabled() {
+		// A message is charged all at once, so the burst must allow the
+		// largest one.
+		limit := s.ByteRate
+		if limit.Burst < int(maxMessageSize) {
+			limit.Burst = int(maxMessageSize)
+		}
+		lr.bytes = limit.bucket()
+	}
+	sr.control = lr.limitControl(sr.control)
+	return lr
+}
+
+// newConn sets up an encrypted Conn to communicate with the client.
+func (s *Server) newConn(conn io.ReadWriter, commonKey *[keySize]byte, log *slog.Logger, counter *sessionCounter) *Conn {
+	sw := &SecureWriter{w: conn, key: commonKey, Logger: log, Metrics: counter}
+	p := newPinger(sw)
+	mr := newMessageReader(s.limitReader(&SecureReader{r: conn, key: commonKey, Logger: log, Metrics: counter, control: p.control}))
+	closer, _ := conn.(io.Closer)
+	if s.KeepAlive > 0 && closer != nil {
+		go keepAlive(p, mr, closer, s.KeepAlive, s.KeepAliveTimeout)
+	}
+	c := newConn(mr, sw, closer, counter.session)
+	c.mr = mr
+	return c
+}
+
+// handle takes care of client/server behavior after the handshake.
+func (s *Server) handle(c *Conn) error {
+	h := s.Handler
+	if h == nil {
+		h = EchoHandler
+	}
+	return h.ServeSession(c)
+}
+
+func (s *Server) metrics() Metrics {
+	return orNop(s.Metrics)
+}
+
+func (s *Server) logger() *slog.Logger {
+	return orDiscard(s.Logger).With("side", "server")
+}
+
+// timeoutConn is a net.Conn that enforces an idle timeout on each read and an
+// absolute end of session on all IO.
+type timeoutConn struct {
+	net.Conn
+	idle time.Duration
+	end  time.Time
+}
+
+// Read sets the read deadline before reading from the underlying Conn.
+func (c *timeoutConn) Read(buf []byte) (int, error) {
+	if c.idle > 0 {
+		if err := c.Conn.SetReadDeadline(c.deadline(c.idle)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(buf)
+}
+
+// CloseWrite shuts down the writing side of the connection, if supported.
+func (c *timeoutConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// deadline returns the time d from now, but no later than the end of the
+// session.
+func (c *timeoutConn) deadline(d time.Duration) time.Time {
+	t := time.Now().Add(d)
+	if !c.end.IsZero() && c.end.Before(t) {
+		return c.end
+	}
+	return t
 }
 
 // Client is the secure echo client.
 type Client struct {
-	keyPair   *KeyPair
-	commonKey *[32]byte
+	keyPair     *KeyPair
+	commonKey   *[32]byte
+	serverKey   *[32]byte
+	expectedKey *[32]byte
+	cookie      []byte
+
+	// Logger, if set, receives diagnostics about the connection.
+	Logger *slog.Logger
+
+	// KeepAlive is how often to ping the server. If it doesn't reply within
+	// KeepAliveTimeout, the connection is closed and reads fail with
+	// ErrDeadPeer. Zero disables pings.
+	KeepAlive time.Duration
+
+	// KeepAliveTimeout limits how long to wait for a reply to a ping. Zero
+	// means the same as KeepAlive.
+	KeepAliveTimeout time.Duration
+
+	// Hooks are called as the session with the server progresses.
+	Hooks
 }
 
 // NewClient initializes a Client with its own keys. The client will perform a
 // handshake with the server to exchange public keys.
 func NewClient(kp *KeyPair) *Client {
-	return &Client{kp, nil}
+	return &Client{keyPair: kp}
 }
 
-// Handshake performs the public key exchange with the server.
+// Handshake performs the public key exchange with the server. If the server
+// replies with a cookie, ErrCookieRequired is returned and the next call to
+// Handshake, on a new connection, presents it.
 func (c *Client) Handshake(conn io.ReadWriter) error {
-	c.debug("Performing key exchange...\n")
-	kp, err := c.keyPair.Exchange(conn)
+	if c.cookie != nil {
+		if err := sendCookie(conn, c.cookie); err != nil {
+			return err
+		}
+		c.cookie = nil
+	}
+	if err := c.keyPair.send(conn); err != nil {
+		return err
+	}
+	kp, cookie, err := c.keyPair.recvHello(conn, false)
 	if err != nil {
 		return err
 	}
+	if kp == nil {
+		c.logger().Debug("received cookie")
+		c.cookie = cookie
+		return ErrCookieRequired
+	}
+	if c.expectedKey != nil && *kp.pub != *c.expectedKey {
+		return ErrUnexpectedKey
+	}
+	if err := c.callHandshake(kp.pub); err != nil {
+		return err
+	}
+	c.serverKey = kp.pub
 	c.commonKey = kp.CommonKey()
+	c.logger().Debug("handshake complete", "peer", Fingerprint(kp.pub))
 	return nil
 }
 
 // SecureConn returns a ReadWriteCloser to communicate with the server.
 // Requires that the shared key has been provided, probably by getting it via
-// Handshake.
+// Handshake. Closing it ends the session.
 func (c *Client) SecureConn(conn io.ReadWriteCloser) io.ReadWriteCloser {
-	r := &SecureReader{conn, c.commonKey}
-	w := &SecureWriter{conn, c.commonKey}
-	return struct {
-		io.Reader
-		io.Writer
-		io.Closer
-	}{r, w, conn}
+	log := c.logger()
+	counter := &sessionCounter{
+		Metrics: nopMetrics{},
+		session: Session{Start: time.Now()},
+	}
+	if c.serverKey != nil {
+		log = log.With("peer", Fingerprint(c.serverKey))
+		counter.session.Peer = *c.serverKey
+	}
+	if nc, ok := conn.(net.Conn); ok {
+		counter.session.RemoteAddr = nc.RemoteAddr()
+	}
+	c.callSessionStart(counter.session)
+
+	sw := &SecureWriter{w: conn, key: c.commonKey, Logger: log, Metrics: counter}
+	p := newPinger(sw)
+	mr := newMessageReader(&SecureReader{r: conn, key: c.commonKey, Logger: log, Metrics: counter, control: p.control})
+	if c.KeepAlive > 0 {
+		go keepAlive(p, mr, conn, c.KeepAlive, c.KeepAliveTimeout)
+	}
+	return &clientConn{
+		r:       mr,
+		w:       sw,
+		pinger:  p,
+		conn:    conn,
+		hooks:   &c.Hooks,
+		counter: counter,
+	}
 }
 
-func (c *Client) debug(str string, v ...interface{}) {
-	debugf("client: %s", fmt.Sprintf(str, v...))
+func (c *Client) logger() *slog.Logger {
+	return orDiscard(c.Logger).With("side", "client")
 }
@@ -3,7 +3,9 @@ package main
 import (
 	"bytes"
 	"io"
+	"net"
 	"testing"
+	"time"
 )
 
 func newFakeKeyPair(pub, priv string) *KeyPair {
@@ -13,9 +15,39 @@ func newFakeKeyPair(pub, priv string) *KeyPair {
 	return &KeyPair{&a, &b}
 }
 
+// newTestServer starts s on a loopback listener and returns its address and
+// a function that stops it.
+func newTestServer(t *testing.T, s *Server) (addr string, closer func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// newTCPPair returns both ends of a loopback TCP connection. Unlike net.Pipe,
+// writes are buffered so both sides may send their keys at once.
+func newTCPPair(t *testing.T) (client, server net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
 func Test_Server_handshake(t *testing.T) {
 	kp := newFakeKeyPair("a", "b")
-	s := Server{kp}
+	s := Server{keyPair: kp}
 
 	r := bytes.NewBuffer([]byte{})
 	w := bytes.NewBuffer([]byte{})
@@ -30,7 +62,7 @@ func Test_Server_handshake(t *testing.T) {
 		io.Writer
 	}{r, w}
 
-	commonKey, err := s.handshake(rw)
+	peer, err := s.handshake(rw, "127.0.0.1")
 	if err != nil {
 		t.Fatalf("Want no error in handshake")
 	}
@@ -39,29 +71,34 @@ func Test_Server_handshake(t *testing.T) {
 	if !bytes.Equal(w.Bytes(), kp.pub[:]) {
 		t.Errorf("Send key: got %#v, want %#v", w.Bytes(), kp.pub)
 	}
-	// Server received commonKey
-	if nil == commonKey {
-		t.Errorf("Got nil, want common key")
+	// Server received the client's key.
+	if nil == peer || *peer.pub != clientPub {
+		t.Errorf("Got %v, want client's key", peer)
 	}
 }
 
 func Test_Server_handle(t *testing.T) {
 	kp := newFakeKeyPair("a", "b")
-	s := Server{kp}
-	r, w := io.Pipe()
+	s := Server{keyPair: kp}
+	// The server reads in the background, so each direction needs its own
+	// pipe.
+	cr, cw := io.Pipe()
+	sr, sw := io.Pipe()
 
 	var out = make([]byte, 1024)
 	var outSize = 0
 
 	// Fake Client performs the expected IO. Uses server's keys for simplicity.
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		var err error
-		sr := NewSecureReader(r, kp.priv, kp.pub)
-		sw := NewSecureWriter(w, kp.priv, kp.pub)
-		if _, err := sw.Write([]byte("hello")); err != nil {
+		r := NewSecureReader(sr, kp.priv, kp.pub)
+		w := NewSecureWriter(cw, kp.priv, kp.pub)
+		if _, err := w.Write([]byte("hello")); err != nil {
 			t.Fatalf("Want no error writing message")
 		}
-		if outSize, err = sr.Read(out); err != nil {
+		if outSize, err = r.Read(out); err != nil {
 			t.Fatalf("Want no error reading message")
 		}
 	}()
@@ -70,12 +107,14 @@ func Test_Server_handle(t *testing.T) {
 	rw := struct {
 		io.Reader
 		io.Writer
-	}{r, w}
+	}{cr, sw}
 
 	commonKey := kp.CommonKey()
-	if err := s.handle(rw, commonKey); err != nil {
+	c := s.newConn(rw, commonKey, discardLogger, &sessionCounter{Metrics: nopMetrics{}})
+	if err := s.handle(c); err != nil {
 		t.Fatalf("Want no error in handle")
 	}
+	<-done
 
 	wantOut := []byte("hello")
 	if !bytes.Equal(out[:outSize], wantOut) {
@@ -83,9 +122,101 @@ func Test_Server_handle(t *testing.T) {
 	}
 }
 
+func Test_Server_serveConn_handshakeError(t *testing.T) {
+	kp := newFakeKeyPair("a", "b")
+	s := NewServer(kp)
+	client, server := net.Pipe()
+
+	var gotErr error
+	s.OnHandshakeError = func(addr net.Addr, err error) {
+		gotErr = err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.serveConn(server)
+		close(done)
+	}()
+
+	// Read the server's key, then hang up without sending ours.
+	buf := make([]byte, keySize)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("Read server key got error %s", err)
+	}
+	client.Close()
+	<-done
+
+	if gotErr == nil {
+		t.Fatalf("Want OnHandshakeError to be called with an error")
+	}
+}
+
+func Test_Server_serveConn_handshakeTimeout(t *testing.T) {
+	kp := newFakeKeyPair("a", "b")
+	s := NewServer(kp)
+	s.HandshakeTimeout = 10 * time.Millisecond
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errs := make(chan error, 1)
+	s.OnHandshakeError = func(addr net.Addr, err error) {
+		errs <- err
+	}
+
+	// Never send a key to the server.
+	go io.Copy(io.Discard, client)
+	go s.serveConn(server)
+
+	select {
+	case err := <-errs:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("Got error %s, want a timeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Want the handshake to time out")
+	}
+}
+
+func Test_Server_serveConn_idleTimeout(t *testing.T) {
+	kp := newFakeKeyPair("a", "b")
+	s := NewServer(kp)
+	s.IdleTimeout = 10 * time.Millisecond
+	client, server := newTCPPair(t)
+	defer client.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.serveConn(server)
+		close(done)
+	}()
+
+	// Complete the handshake, then go quiet.
+	if err := NewClient(newFakeKeyPair("c", "d")).Handshake(client); err != nil {
+		t.Fatalf("Handshake got error %s", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Want the idle session to be closed")
+	}
+}
+
+func Test_timeoutConn_deadline(t *testing.T) {
+	end := time.Now().Add(time.Minute)
+	c := &timeoutConn{end: end}
+
+	if got := c.deadline(time.Hour); !got.Equal(end) {
+		t.Errorf("Got %s, want deadline capped at %s", got, end)
+	}
+	if got := c.deadline(time.Second); !got.Before(end) {
+		t.Errorf("Got %s, want deadline before %s", got, end)
+	}
+}
+
 func Test_Client_Handshake(t *testing.T) {
 	kp := newFakeKeyPair("a", "b")
-	c := Client{kp, nil}
+	c := Client{keyPair: kp}
 	r := bytes.NewBuffer([]byte{})
 	w := bytes.NewBuffer([]byte{})
 
@@ -116,7 +247,7 @@ func Test_Client_Handshake(t *testing.T) {
 func Test_Client_SecureConn(t *testing.T) {
 	kp := newFakeKeyPair("a", "b")
 	commonKey := kp.CommonKey()
-	c := Client{kp, commonKey}
+	c := Client{keyPair: kp, commonKey: commonKey}
 	r, w := io.Pipe()
 
 	// Fake a io.ReadWriteCloser
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// pipe copies in to conn and conn to out, like nc. When in is exhausted the
+// peer is told there's no more data. pipe returns once both directions are
+// done, or sending to the peer fails.
+func pipe(conn io.ReadWriter, in io.Reader, out io.Writer) error {
+	errc := make(chan error, 1)
+	go func() {
+		// Hide any WriterTo so that each chunk fits in a message.
+		_, err := io.CopyBuffer(conn, struct{ io.Reader }{in}, make([]byte, maxMessageSize))
+		if err == nil {
+			err = closeWrite(conn)
+		}
+		errc <- err
+	}()
+	if _, err := io.Copy(out, conn); err != nil {
+		return err
+	}
+	// The peer may still be reading, so finish sending before the caller
+	// closes the connection.
+	return <-errc
+}
+
+// connect dials a server and pipes in and out through the connection.
+func connect(ctx context.Context, addr string, in io.Reader, out io.Writer, opts ...DialOption) error {
+	conn, err := DialContext(ctx, "tcp", addr, opts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return pipe(conn, in, out)
+}
+
+// listen waits for one client on l and pipes in and out through its session.
+func listen(l net.Listener, in io.Reader, out io.Writer, logger *slog.Logger) error {
+	kp := NewKeyPair()
+	s := NewServer(kp)
+	s.Logger = logger
+	s.Handler = HandlerFunc(func(c *Conn) error {
+		return pipe(c, in, out)
+	})
+	var result error
+	s.OnHandshakeError = func(addr net.Addr, err error) {
+		result = err
+	}
+	s.OnSessionEnd = func(stats SessionStats, err error) {
+		result = err
+	}
+	orDiscard(logger).Info("listening", "addr", l.Addr(), "key", Fingerprint(kp.pub))
+
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	l.Close()
+	s.serveConn(conn)
+	return result
+}
+
+// hostPort adds host to addr if it's only a port.
+func hostPort(addr, host string) string {
+	if strings.Contains(addr, ":") {
+		return addr
+	}
+	return host + ":" + addr
+}
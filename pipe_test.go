@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_connect_listen(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// More than one message each way.
+	fromServer := strings.Repeat("s", int(maxMessageSize)+100)
+	fromClient := strings.Repeat("c", int(maxMessageSize)*2+7)
+
+	var serverOut bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- listen(l, strings.NewReader(fromServer), &serverOut, nil)
+	}()
+
+	var clientOut bytes.Buffer
+	if err := connect(context.Background(), l.Addr().String(), strings.NewReader(fromClient), &clientOut); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if clientOut.String() != fromServer {
+		t.Errorf("Client got %d bytes, want %d", clientOut.Len(), len(fromServer))
+	}
+	if serverOut.String() != fromClient {
+		t.Errorf("Server got %d bytes, want %d", serverOut.Len(), len(fromClient))
+	}
+}
+
+func Test_hostPort(t *testing.T) {
+	for _, tt := range []struct{ addr, want string }{
+		{"1234", "localhost:1234"},
+		{":1234", ":1234"},
+		{"example.com:1234", "example.com:1234"},
+	} {
+		if got := hostPort(tt.addr, "localhost"); got != tt.want {
+			t.Errorf("hostPort(%q) got %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
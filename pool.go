@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned by Pool.Get after the pool is closed.
+var ErrPoolClosed = errors.New("pool closed")
+
+// ErrPoolNoServerKey is returned by Pool.Get when no server key is given.
+var ErrPoolNoServerKey = errors.New("pool needs the server's key")
+
+// Pinger is implemented by connections returned from Dial. Ping sends a ping
+// to the server and waits for the reply.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Pool keeps authenticated connections open for reuse, saving a connect and
+// key exchange for each use. Connections are pooled separately for each
+// network, address and expected server key. The zero value is ready to use.
+type Pool struct {
+	// MaxIdle is how many idle connections to keep for each server. Zero
+	// means 2.
+	MaxIdle int
+
+	// MaxOpen limits how many connections may be open to each server. Get
+	// waits when the limit is reached. Zero means no limit.
+	MaxOpen int
+
+	// IdleTimeout closes connections that have been idle this long. Zero
+	// means they're kept until the server hangs up.
+	IdleTimeout time.Duration
+
+	// PingAfter is how long a connection may be idle before it's pinged to
+	// check that the server is still there before reuse. Zero means always.
+	PingAfter time.Duration
+
+	// PingTimeout limits how long to wait for the server's reply to a ping.
+	// Zero means 1 second.
+	PingTimeout time.Duration
+
+	// Options are used when dialing new connections.
+	Options []DialOption
+
+	mu     sync.Mutex
+	hosts  map[poolKey]*poolHost
+	closed bool
+	done   chan struct{} // closed by Close to wake waiting Gets
+}
+
+type poolKey struct {
+	network, addr string
+	serverKey     [keySize]byte
+}
+
+// poolHost holds the connections to one server.
+type poolHost struct {
+	idle    []*poolConn
+	open    int
+	waiters []chan *poolConn
+}
+
+type poolConn struct {
+	io.ReadWriteCloser
+	key      poolKey
+	returned time.Time
+}
+
+// Get returns a connection to the server at addr, which must present
+// serverKey. It reuses an idle connection if there is one that answers a
+// ping, and otherwise dials. Close the connection to return it to the pool.
+func (p *Pool) Get(ctx context.Context, network, addr string, serverKey *[keySize]byte) (*PooledConn, error) {
+	if serverKey == nil {
+		return nil, ErrPoolNoServerKey
+	}
+	key := poolKey{network: network, addr: addr, serverKey: *serverKey}
+	for {
+		pc, dial, err := p.take(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if dial {
+			opts := append(p.Options[:len(p.Options):len(p.Options)], WithServerKey(serverKey))
+			conn, err := DialContext(ctx, network, addr, opts...)
+			if err != nil {
+				p.release(key)
+				return nil, err
+			}
+			return &PooledConn{pc: &poolConn{ReadWriteCloser: conn, key: key}, pool: p}, nil
+		}
+		if p.healthy(ctx, pc) {
+			return &PooledConn{pc: pc, pool: p}, nil
+		}
+		pc.Close()
+		p.release(key)
+	}
+}
+
+// take returns an idle connection, or permission to dial a new one, waiting
+// if the server has MaxOpen connections.
+func (p *Pool) take(ctx context.Context, key poolKey) (*poolConn, bool, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, false, ErrPoolClosed
+	}
+	h := p.host(key)
+	if n := len(h.idle); n > 0 {
+		pc := h.idle[n-1]
+		h.idle = h.idle[:n-1]
+		p.mu.Unlock()
+		return pc, false, nil
+	}
+	if p.MaxOpen <= 0 || h.open < p.MaxOpen {
+		h.open++
+		p.mu.Unlock()
+		return nil, true, nil
+	}
+
+	// Wait for a connection to be returned, or for permission to dial when
+	// one is closed.
+	ch := make(chan *poolConn, 1)
+	h.waiters = append(h.waiters, ch)
+	done := p.doneChan()
+	p.mu.Unlock()
+	select {
+	case pc := <-ch:
+		return pc, pc == nil, nil
+	case <-ctx.Done():
+		p.stopWaiting(h, ch, key)
+		return nil, false, ctx.Err()
+	case <-done:
+		p.stopWaiting(h, ch, key)
+		return nil, false, ErrPoolClosed
+	}
+}
+
+// stopWaiting removes ch from the waiters for h.
+func (p *Pool) stopWaiting(h *poolHost, ch chan *poolConn, key poolKey) {
+	p.mu.Lock()
+	for i, w := range h.waiters {
+		if w == ch {
+			h.waiters = append(h.waiters[:i], h.waiters[i+1:]...)
+			break
+		}
+	}
+	p.mu.Unlock()
+	// We may have been handed a connection before being removed.
+	select {
+	case pc := <-ch:
+		if pc != nil {
+			p.put(pc)
+		} else {
+			p.release(key)
+		}
+	default:
+	}
+}
+
+// doneChan returns the channel closed by Close. Must be called with mu held.
+func (p *Pool) doneChan() chan struct{} {
+	if p.done == nil {
+		p.done = make(chan struct{})
+	}
+	return p.done
+}
+
+// host returns the connections for key. Must be called with mu held.
+func (p *Pool) host(key poolKey) *poolHost {
+	if p.hosts == nil {
+		p.hosts = make(map[poolKey]*poolHost)
+	}
+	h := p.hosts[key]
+	if h == nil {
+		h = &poolHost{}
+		p.hosts[key] = h
+	}
+	return h
+}
+
+// healthy reports whether an idle connection can be reused.
+func (p *Pool) healthy(ctx context.Context, pc *poolConn) bool {
+	idle := time.Since(pc.returned)
+	if p.IdleTimeout > 0 && idle > p.IdleTimeout {
+		return false
+	}
+	if idle < p.PingAfter {
+		return true
+	}
+	pinger, ok := pc.ReadWriteCloser.(Pinger)
+	if !ok {
+		return true
+	}
+	timeout := p.PingTimeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return pinger.Ping(ctx) == nil
+}
+
+// put returns a connection to the pool, handing it to a waiting Get if
+// there is one.
+func (p *Pool) put(pc *poolConn) {
+	p.mu.Lock()
+	h := p.host(pc.key)
+	if len(h.waiters) > 0 {
+		ch := h.waiters[0]
+		h.waiters = h.waiters[1:]
+		p.mu.Unlock()
+		ch <- pc
+		return
+	}
+	maxIdle := p.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = 2
+	}
+	if p.closed || len(h.idle) >= maxIdle {
+		p.mu.Unlock()
+		pc.Close()
+		p.release(pc.key)
+		return
+	}
+	pc.returned = time.Now()
+	h.idle = append(h.idle, pc)
+	p.mu.Unlock()
+}
+
+// release records that a connection was closed, letting a waiting Get dial
+// in its place.
+func (p *Pool) release(key poolKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := p.host(key)
+	if len(h.waiters) > 0 {
+		ch := h.waiters[0]
+		h.waiters = h.waiters[1:]
+		ch <- nil
+		return
+	}
+	h.open--
+}
+
+// Close closes all idle connections and wakes any Get waiting for a
+// connection, which returns ErrPoolClosed. Connections in use are closed when
+// they're returned.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if !p.closed {
+		close(p.doneChan())
+	}
+	p.closed = true
+	var idle []*poolConn
+	for _, h := range p.hosts {
+		idle = append(idle, h.idle...)
+		h.open -= len(h.idle)
+		h.idle = nil
+	}
+	p.mu.Unlock()
+	for _, pc := range idle {
+		pc.Close()
+	}
+	return nil
+}
+
+// PooledConn is a connection from a Pool.
+type PooledConn struct {
+	pc   *poolConn
+	pool *Pool
+
+	mu     sync.Mutex
+	broken bool
+	closed bool
+}
+
+// Read implements io.Reader.
+func (c *PooledConn) Read(buf []byte) (int, error) {
+	n, err := c.pc.Read(buf)
+	if err != nil {
+		c.setBroken()
+	}
+	return n, err
+}
+
+// Write implements io.Writer.
+func (c *PooledConn) Write(buf []byte) (int, error) {
+	n, err := c.pc.Write(buf)
+	if err != nil {
+		c.setBroken()
+	}
+	return n, err
+}
+
+// Ping implements Pinger.
+func (c *PooledConn) Ping(ctx context.Context) error {
+	err := c.pc.ReadWriteCloser.(Pinger).Ping(ctx)
+	if err != nil {
+		c.setBroken()
+	}
+	return err
+}
+
+// Discard closes the connection instead of returning it to the pool, for
+// when the caller has left it in an unknown state.
+func (c *PooledConn) Discard() error {
+	c.setBroken()
+	return c.Close()
+}
+
+// Close returns the connection to the pool, or closes it if Read or Write
+// failed or data from the server is waiting to be read. Data still on its way
+// can't be detected, so read replies in full before closing, or call Discard
+// instead.
+func (c *PooledConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	broken := c.broken
+	c.mu.Unlock()
+
+	if p, ok := c.pc.ReadWriteCloser.(interface {
+		pending() bool
+	}); ok && p.pending() {
+		broken = true
+	}
+
+	if broken {
+		err := c.pc.Close()
+		c.pool.release(c.pc.key)
+		return err
+	}
+	c.pool.put(c.pc)
+	return nil
+}
+
+func (c *PooledConn) setBroken() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.broken = true
+}
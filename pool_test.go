@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countSessions returns the number of sessions s has started, updated as
+// they start.
+func countSessions(s *Server) *int32 {
+	n := new(int32)
+	s.OnSessionStart = func(Session) {
+		atomic.AddInt32(n, 1)
+	}
+	return n
+}
+
+func echo(t *testing.T, conn io.ReadWriter, msg string) {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Errorf("Got %q, want %q", buf, msg)
+	}
+}
+
+func Test_Pool_reuse(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = StreamEchoHandler
+	sessions := countSessions(s)
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	pub := s.keyPair.pub
+
+	var p Pool
+	defer p.Close()
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		c, err := p.Get(ctx, "tcp", addr, pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, c, "hello")
+		c.Close()
+	}
+	if n := atomic.LoadInt32(sessions); n != 1 {
+		t.Errorf("Got %d sessions, want 1", n)
+	}
+}
+
+func Test_Pool_serverKey(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = StreamEchoHandler
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	var p Pool
+	defer p.Close()
+	if _, err := p.Get(context.Background(), "tcp", addr, NewKeyPair().pub); err != ErrUnexpectedKey {
+		t.Errorf("Got %v, want %v", err, ErrUnexpectedKey)
+	}
+	if _, err := p.Get(context.Background(), "tcp", addr, nil); !errors.Is(err, ErrPoolNoServerKey) {
+		t.Errorf("Got %v, want %v", err, ErrPoolNoServerKey)
+	}
+}
+
+func Test_Pool_deadConn(t *testing.T) {
+	// EchoHandler hangs up after one message.
+	s := NewServer(NewKeyPair())
+	s.Handler = EchoHandler
+	sessions := countSessions(s)
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	pub := s.keyPair.pub
+
+	var p Pool
+	defer p.Close()
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		c, err := p.Get(ctx, "tcp", addr, pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, c, "hello")
+		c.Close()
+	}
+	if n := atomic.LoadInt32(sessions); n != 2 {
+		t.Errorf("Got %d sessions, want 2", n)
+	}
+}
+
+func Test_Pool_MaxOpen(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = StreamEchoHandler
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	pub := s.keyPair.pub
+
+	p := Pool{MaxOpen: 1}
+	defer p.Close()
+	c, err := p.Get(context.Background(), "tcp", addr, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx, "tcp", addr, pub); err != context.DeadlineExceeded {
+		t.Errorf("Got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	got := make(chan *PooledConn)
+	go func() {
+		c, err := p.Get(context.Background(), "tcp", addr, pub)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- c
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	c2 := <-got
+	if c2 == nil || c2.pc != c.pc {
+		t.Errorf("Want the returned connection to be handed over")
+	}
+}
+
+func Test_Pool_Close_waiting(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = StreamEchoHandler
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	pub := s.keyPair.pub
+
+	p := Pool{MaxOpen: 1}
+	c, err := p.Get(context.Background(), "tcp", addr, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := p.Get(context.Background(), "tcp", addr, pub)
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Close()
+	select {
+	case err := <-errc:
+		if err != ErrPoolClosed {
+			t.Errorf("Got %v, want %v", err, ErrPoolClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Want Close to wake the waiting Get")
+	}
+}
+
+func Test_Pool_unreadData(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = StreamEchoHandler
+	sessions := countSessions(s)
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	pub := s.keyPair.pub
+
+	var p Pool
+	defer p.Close()
+	ctx := context.Background()
+	c, err := p.Get(ctx, "tcp", addr, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// Leave part of the echo unread.
+	if _, err := io.ReadFull(c, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c, err = p.Get(ctx, "tcp", addr, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echo(t, c, "again")
+	if n := atomic.LoadInt32(sessions); n != 2 {
+		t.Errorf("Got %d sessions, want 2", n)
+	}
+}
+
+func Test_Pool_MaxIdle(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = StreamEchoHandler
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	pub := s.keyPair.pub
+
+	p := Pool{MaxIdle: 1}
+	defer p.Close()
+	ctx := context.Background()
+	c1, err := p.Get(ctx, "tcp", addr, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := p.Get(ctx, "tcp", addr, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1.Close()
+	c2.Close()
+
+	h := p.hosts[poolKey{"tcp", addr, *pub}]
+	if len(h.idle) != 1 || h.open != 1 {
+		t.Errorf("Got %d idle and %d open, want 1 and 1", len(h.idle), h.open)
+	}
+}
+
+func Test_Pool_Discard(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = StreamEchoHandler
+	sessions := countSessions(s)
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	pub := s.keyPair.pub
+
+	var p Pool
+	defer p.Close()
+	ctx := context.Background()
+	c, err := p.Get(ctx, "tcp", addr, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Discard()
+	c, err = p.Get(ctx, "tcp", addr, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if n := atomic.LoadInt32(sessions); n != 2 {
+		t.Errorf("Got %d sessions, want 2", n)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when a client exceeds one of the Server's rate
+// limits. The client's connection is closed.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimit configures a token bucket. Rate is the number of events allowed
+// per second on average, and Burst is how many may happen at once. A zero
+// Rate means no limit. A zero Burst allows one second's worth of events.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+// bucket returns a new, full token bucket for the limit.
+func (l RateLimit) bucket() *tokenBucket {
+	burst := float64(l.Burst)
+	if burst <= 0 {
+		burst = math.Ceil(l.Rate)
+	}
+	return &tokenBucket{rate: l.Rate, burst: burst, tokens: burst}
+}
+
+// tokenBucket is a rate limiter that holds up to burst tokens and refills at
+// rate tokens per second.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	used   time.Time
+}
+
+// allow takes n tokens from the bucket, returning false if there aren't
+// enough.
+func (b *tokenBucket) allow(now time.Time, n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.used = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// full reports whether the bucket has refilled completely, in which case it
+// behaves the same as a new bucket.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// lastUsed returns when tokens were last asked for.
+func (b *tokenBucket) lastUsed() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// maxBuckets is how many per-key buckets a bucketMap holds. Beyond that, it
+// forgets the ones that have refilled, and then the least recently used.
+const maxBuckets = 1024
+
+// bucketMap holds a token bucket for each key, such as a client's IP.
+type bucketMap struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// allow takes a token from the bucket for key, creating it from limit if
+// needed.
+func (m *bucketMap) allow(key string, limit RateLimit, now time.Time) bool {
+	m.mu.Lock()
+	if m.buckets == nil {
+		m.buckets = make(map[string]*tokenBucket)
+	}
+	b, ok := m.buckets[key]
+	if !ok {
+		if len(m.buckets) >= maxBuckets {
+			m.evict(now)
+		}
+		b = limit.bucket()
+		m.buckets[key] = b
+	}
+	m.mu.Unlock()
+	return b.allow(now, 1)
+}
+
+// evict makes room for a new bucket. Must be called with mu held.
+func (m *bucketMap) evict(now time.Time) {
+	for k, b := range m.buckets {
+		if b.full(now) {
+			delete(m.buckets, k)
+		}
+	}
+	if len(m.buckets) < maxBuckets {
+		return
+	}
+	// During a flood from many keys few buckets refill, so drop the least
+	// recently used quarter to make room for a while.
+	type entry struct {
+		key  string
+		used time.Time
+	}
+	entries := make([]entry, 0, len(m.buckets))
+	for k, b := range m.buckets {
+		entries = append(entries, entry{k, b.lastUsed()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+	for _, e := range entries[:len(entries)-maxBuckets*3/4] {
+		delete(m.buckets, e.key)
+	}
+}
+
+// rateLimitedReader limits the rate of Reads and bytes read from a
+// SecureReader, where each Read returns one message.
+type rateLimitedReader struct {
+	r      io.Reader
+	frames *tokenBucket
+	bytes  *tokenBucket
+}
+
+// Read implements io.Reader. It returns ErrRateLimited once the client has
+// gone over either limit.
+func (r *rateLimitedReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	if err != nil {
+		return n, err
+	}
+	if !r.allow(n) {
+		return 0, ErrRateLimited
+	}
+	return n, nil
+}
+
+// allow charges one message of n bytes to the limits.
+func (r *rateLimitedReader) allow(n int) bool {
+	now := time.Now()
+	if r.frames != nil && !r.frames.allow(now, 1) {
+		return false
+	}
+	if r.bytes != nil && !r.bytes.allow(now, float64(n)) {
+		return false
+	}
+	return true
+}
+
+// limitControl returns a control message handler that charges each control
+// message to the limits before passing it on to next, so that pings can't be
+// used to get around them.
+func (r *rateLimitedReader) limitControl(next func(byte) error) func(byte) error {
+	return func(typ byte) error {
+		if !r.allow(1) {
+			return ErrRateLimited
+		}
+		if next == nil {
+			return nil
+		}
+		return next(typ)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_tokenBucket_allow(t *testing.T) {
+	b := RateLimit{Rate: 10, Burst: 2}.bucket()
+	now := time.Now()
+
+	if !b.allow(now, 1) || !b.allow(now, 1) {
+		t.Fatalf("Want burst of 2 to be allowed")
+	}
+	if b.allow(now, 1) {
+		t.Errorf("Want third event to be denied")
+	}
+	if !b.allow(now.Add(100*time.Millisecond), 1) {
+		t.Errorf("Want one token after 100ms")
+	}
+	if b.full(now.Add(100 * time.Millisecond)) {
+		t.Errorf("Want bucket not to be full")
+	}
+	if !b.full(now.Add(time.Second)) {
+		t.Errorf("Want bucket to be full after a second")
+	}
+}
+
+func Test_RateLimit_bucket_defaultBurst(t *testing.T) {
+	b := RateLimit{Rate: 2.5}.bucket()
+	if b.burst != 3 {
+		t.Errorf("Got burst %v, want 3", b.burst)
+	}
+}
+
+func Test_bucketMap_allow(t *testing.T) {
+	var m bucketMap
+	limit := RateLimit{Rate: 1}
+	now := time.Now()
+
+	if !m.allow("a", limit, now) {
+		t.Errorf("Want first event from a to be allowed")
+	}
+	if m.allow("a", limit, now) {
+		t.Errorf("Want second event from a to be denied")
+	}
+	if !m.allow("b", limit, now) {
+		t.Errorf("Want first event from b to be allowed")
+	}
+}
+
+func Test_bucketMap_allow_evict(t *testing.T) {
+	var m bucketMap
+	limit := RateLimit{Rate: 0.001, Burst: 1}
+	now := time.Now()
+
+	// None of these buckets refill, so the oldest are dropped to make room.
+	for i := 0; i < maxBuckets*2; i++ {
+		m.allow(strconv.Itoa(i), limit, now.Add(time.Duration(i)))
+	}
+	if len(m.buckets) > maxBuckets {
+		t.Errorf("Got %d buckets, want at most %d", len(m.buckets), maxBuckets)
+	}
+	if _, ok := m.buckets[strconv.Itoa(maxBuckets*2-1)]; !ok {
+		t.Errorf("Want the newest bucket kept")
+	}
+	if _, ok := m.buckets["0"]; ok {
+		t.Errorf("Want the oldest bucket dropped")
+	}
+}
+
+func Test_Server_limitReader_byteBurst(t *testing.T) {
+	key := &[32]byte{}
+	var buf bytes.Buffer
+	sw := SecureWriter{w: &buf, key: key}
+	sw.Write(make([]byte, maxMessageSize))
+
+	// The default burst would be 100 bytes, which no large message fits.
+	s := NewServer(NewKeyPair())
+	s.ByteRate = RateLimit{Rate: 100}
+	r := s.limitReader(&SecureReader{r: &buf, key: key})
+	if _, err := r.Read(make([]byte, maxMessageSize)); err != nil {
+		t.Errorf("Got error %v, want the message", err)
+	}
+}
+
+func Test_rateLimitedReader_Read(t *testing.T) {
+	r := &rateLimitedReader{
+		r:      bytes.NewReader(make([]byte, 100)),
+		frames: RateLimit{Rate: 1, Burst: 1}.bucket(),
+	}
+	buf := make([]byte, 10)
+	if _, err := r.Read(buf); err != nil {
+		t.Fatalf("Read got error %s", err)
+	}
+	if _, err := r.Read(buf); err != ErrRateLimited {
+		t.Errorf("Got error %v, want %v", err, ErrRateLimited)
+	}
+
+	r = &rateLimitedReader{
+		r:     bytes.NewReader(make([]byte, 100)),
+		bytes: RateLimit{Rate: 15}.bucket(),
+	}
+	if _, err := r.Read(buf); err != nil {
+		t.Fatalf("Read got error %s", err)
+	}
+	if _, err := r.Read(buf); err != ErrRateLimited {
+		t.Errorf("Got error %v, want %v", err, ErrRateLimited)
+	}
+}
+
+func Test_Server_limitReader_control(t *testing.T) {
+	key := &[32]byte{}
+	var buf bytes.Buffer
+	sw := SecureWriter{w: &buf, key: key}
+	for i := 0; i < 3; i++ {
+		sw.writeControl(controlPing)
+	}
+	sw.Write([]byte("data"))
+
+	// Pings count against the frame limit, even though Read never returns
+	// them.
+	var pings int
+	s := NewServer(NewKeyPair())
+	s.FrameRate = RateLimit{Rate: 0.001, Burst: 2}
+	r := s.limitReader(&SecureReader{r: &buf, key: key, control: func(typ byte) error {
+		pings++
+		return nil
+	}})
+	if _, err := r.Read(make([]byte, 10)); err != ErrRateLimited {
+		t.Errorf("Got error %v, want %v", err, ErrRateLimited)
+	}
+	if pings != 2 {
+		t.Errorf("Got %d pings handled, want 2", pings)
+	}
+}
+
+func Test_Server_serveConn_handshakeRate(t *testing.T) {
+	s := NewServer(newFakeKeyPair("a", "b"))
+	s.HandshakeRatePerIP = RateLimit{Rate: 0.001, Burst: 1}
+
+	errs := make(chan error, 2)
+	s.OnHandshakeError = func(addr net.Addr, err error) {
+		errs <- err
+	}
+
+	// The first client uses up the burst.
+	client, server := newTCPPair(t)
+	go s.serveConn(server)
+	client.Close()
+	<-errs
+
+	// The second is turned away before the handshake.
+	client, server = newTCPPair(t)
+	defer client.Close()
+	go s.serveConn(server)
+	if err := <-errs; err != ErrRateLimited {
+		t.Errorf("Got error %v, want %v", err, ErrRateLimited)
+	}
+}
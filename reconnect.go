@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrClientClosed is returned by a client connection or ReconnectingClient
+// after Close.
+var ErrClientClosed = errors.New("client closed")
+
+// ConnState is the state of a ReconnectingClient's connection.
+type ConnState int
+
+const (
+	// StateConnecting means a connection attempt is in progress.
+	StateConnecting ConnState = iota
+
+	// StateConnected means the handshake succeeded and the connection is
+	// ready to use.
+	StateConnected
+
+	// StateDisconnected means the connection was lost or an attempt failed.
+	// Another attempt follows after a delay.
+	StateDisconnected
+
+	// StateClosed means the client was closed, or the server presented a
+	// key other than the pinned one, and won't reconnect.
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Backoff configures the delay between connection attempts. The delay starts
+// at Initial and is multiplied by Multiplier after each failure, up to Max.
+// Each delay is then reduced by a random fraction up to Jitter, so that many
+// clients don't reconnect in lockstep. Zero fields take default values.
+type Backoff struct {
+	Initial    time.Duration // default 100ms
+	Max        time.Duration // default 30s
+	Multiplier float64       // default 2
+	Jitter     float64       // default 0.2
+}
+
+// delay returns how long to wait before attempt, counting from zero. random
+// returns a number in [0, 1).
+func (b Backoff) delay(attempt int, random func() float64) time.Duration {
+	initial, max, mult, jitter := b.Initial, b.Max, b.Multiplier, b.Jitter
+	if initial <= 0 {
+		initial = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	if mult < 1 {
+		mult = 2
+	}
+	if jitter <= 0 {
+		jitter = 0.2
+	}
+	d := float64(initial) * math.Pow(mult, float64(attempt))
+	if d > float64(max) {
+		d = float64(max)
+	}
+	return time.Duration(d * (1 - jitter*random()))
+}
+
+// ReconnectConfig configures a ReconnectingClient.
+type ReconnectConfig struct {
+	// Backoff sets the delay between connection attempts.
+	Backoff Backoff
+
+	// OnStateChange, if set, is called whenever the connection changes
+	// state, with the error that caused a disconnect. It must not block.
+	OnStateChange func(state ConnState, err error)
+}
+
+// ReconnectingClient is a secure connection to a server that dials again
+// whenever the connection is lost. Each connection performs a new handshake,
+// so options such as WithServerKey are checked every time. A server that
+// presents the wrong key isn't retried: the client closes, and Read and Write
+// return ErrUnexpectedKey.
+//
+// Read and Write wait for a connection. When either fails, the error is
+// returned and the client reconnects in the background; the caller decides
+// whether to retry. Messages in flight when a connection is lost may not have
+// been delivered.
+type ReconnectingClient struct {
+	network string
+	addr    string
+	opts    []DialOption
+	config  ReconnectConfig
+	cancel  context.CancelFunc
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	conn   io.ReadWriteCloser
+	broken chan error
+	closed bool
+	err    error // why the client closed itself, if it did
+}
+
+// DialReconnecting returns a ReconnectingClient that keeps a connection to
+// the server at addr open until Close is called or ctx is done. It returns
+// immediately; the first connection is made in the background.
+func DialReconnecting(ctx context.Context, network, addr string, config ReconnectConfig, opts ...DialOption) *ReconnectingClient {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &ReconnectingClient{
+		network: network,
+		addr:    addr,
+		opts:    opts,
+		config:  config,
+		cancel:  cancel,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.run(ctx)
+	return c
+}
+
+// run connects, waits for the connection to break, and repeats until ctx is
+// done.
+func (c *ReconnectingClient) run(ctx context.Context) {
+	defer c.Close()
+	for attempt := 0; ; {
+		c.setState(StateConnecting, nil)
+		conn, err := DialContext(ctx, c.network, c.addr, c.opts...)
+		if ctx.Err() != nil {
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		if errors.Is(err, ErrUnexpectedKey) {
+			c.closeWith(err)
+			return
+		}
+		if err != nil {
+			c.setState(StateDisconnected, err)
+			if !sleep(ctx, c.config.Backoff.delay(attempt, rand.Float64)) {
+				return
+			}
+			attempt++
+			continue
+		}
+		attempt = 0
+
+		broken := make(chan error, 1)
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			conn.Close()
+			return
+		}
+		c.conn = conn
+		c.broken = broken
+		c.mu.Unlock()
+		c.cond.Broadcast()
+		c.setState(StateConnected, nil)
+
+		select {
+		case err = <-broken:
+			c.setState(StateDisconnected, err)
+		case <-ctx.Done():
+			return
+		}
+
+		// Pause briefly even after a good connection, in case the server
+		// accepts and then immediately hangs up.
+		if !sleep(ctx, c.config.Backoff.delay(0, rand.Float64)) {
+			return
+		}
+	}
+}
+
+// sleep waits for d, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *ReconnectingClient) setState(state ConnState, err error) {
+	if c.config.OnStateChange != nil {
+		c.config.OnStateChange(state, err)
+	}
+}
+
+// current waits for a connection.
+func (c *ReconnectingClient) current() (io.ReadWriteCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.conn == nil && !c.closed {
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	return c.conn, nil
+}
+
+// fail closes conn, if it's still current, and triggers a reconnect.
+func (c *ReconnectingClient) fail(conn io.ReadWriteCloser, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != conn {
+		return
+	}
+	conn.Close()
+	c.conn = nil
+	c.broken <- err
+}
+
+// Read implements io.Reader, waiting for a connection if necessary.
+func (c *ReconnectingClient) Read(buf []byte) (int, error) {
+	conn, err := c.current()
+	if err != nil {
+		return 0, err
+	}
+	n, err := conn.Read(buf)
+	if err != nil {
+		c.fail(conn, err)
+	}
+	return n, err
+}
+
+// Write implements io.Writer, waiting for a connection if necessary.
+func (c *ReconnectingClient) Write(buf []byte) (int, error) {
+	conn, err := c.current()
+	if err != nil {
+		return 0, err
+	}
+	n, err := conn.Write(buf)
+	if err != nil {
+		c.fail(conn, err)
+	}
+	return n, err
+}
+
+// Close closes the current connection and stops reconnecting.
+func (c *ReconnectingClient) Close() error {
+	return c.closeWith(nil)
+}
+
+// closeWith closes the client, reporting reason, if any, for the close.
+func (c *ReconnectingClient) closeWith(reason error) error {
+	c.cancel()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.err = reason
+	var err error
+	if c.conn != nil {
+		err = c.conn.Close()
+		c.conn = nil
+	}
+	c.mu.Unlock()
+	c.cond.Broadcast()
+	c.setState(StateClosed, reason)
+	return err
+}
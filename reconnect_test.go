@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Backoff_delay(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2, Jitter: 0.5}
+	none := func() float64 { return 0 }
+	most := func() float64 { return 1 }
+
+	tests := []struct {
+		attempt int
+		random  func() float64
+		want    time.Duration
+	}{
+		{0, none, time.Second},
+		{1, none, 2 * time.Second},
+		{2, none, 4 * time.Second},
+		{3, none, 5 * time.Second},
+		{1, most, time.Second},
+	}
+	for _, test := range tests {
+		if got := b.delay(test.attempt, test.random); got != test.want {
+			t.Errorf("Attempt %d: got %s, want %s", test.attempt, got, test.want)
+		}
+	}
+
+	if got := (Backoff{}).delay(0, none); got != 100*time.Millisecond {
+		t.Errorf("Got %s, want default of 100ms", got)
+	}
+}
+
+func Test_ReconnectingClient(t *testing.T) {
+	kp := NewKeyPair()
+	addr, closer := newTestServer(t, NewServer(kp))
+	defer closer()
+
+	var mu sync.Mutex
+	var states []ConnState
+	config := ReconnectConfig{
+		Backoff: Backoff{Initial: time.Millisecond},
+		OnStateChange: func(s ConnState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			states = append(states, s)
+		},
+	}
+	c := DialReconnecting(context.Background(), "tcp", addr, config, WithServerKey(kp.pub))
+
+	// The echo server hangs up after each message, so every message after
+	// the first needs a new connection.
+	for i := 0; i < 3; i++ {
+		var got string
+		for tries := 0; tries < 10 && got != "hello"; tries++ {
+			buf := make([]byte, 5)
+			if _, err := c.Write([]byte("hello")); err != nil {
+				continue
+			}
+			if n, err := c.Read(buf); err == nil {
+				got = string(buf[:n])
+			}
+		}
+		if got != "hello" {
+			t.Fatalf("Message %d: got %q, want hello", i, got)
+		}
+	}
+	c.Close()
+
+	if _, err := c.Write([]byte("hello")); err != ErrClientClosed {
+		t.Errorf("Got %v, want %v", err, ErrClientClosed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	connected := 0
+	for _, s := range states {
+		if s == StateConnected {
+			connected++
+		}
+	}
+	if connected < 3 {
+		t.Errorf("Got states %v, want at least 3 connections", states)
+	}
+	if last := states[len(states)-1]; last != StateClosed {
+		t.Errorf("Got final state %s, want %s", last, StateClosed)
+	}
+}
+
+func Test_ReconnectingClient_cancelledWhileDialing(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	ended := make(chan struct{}, 1)
+	s.OnSessionEnd = func(SessionStats, error) {
+		ended <- struct{}{}
+	}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	// Cancel once the dial has succeeded but before it returns.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hooks := Hooks{OnSessionStart: func(Session) { cancel() }}
+	c := DialReconnecting(ctx, "tcp", addr, ReconnectConfig{}, WithServerKey(s.keyPair.pub), WithHooks(hooks))
+	defer c.Close()
+
+	select {
+	case <-ended:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The connection was left open")
+	}
+}
+
+func Test_ReconnectingClient_unexpectedKey(t *testing.T) {
+	addr, closer := newTestServer(t, NewServer(NewKeyPair()))
+	defer closer()
+
+	var attempts int32
+	closed := make(chan error, 1)
+	config := ReconnectConfig{
+		Backoff: Backoff{Initial: time.Millisecond},
+		OnStateChange: func(s ConnState, err error) {
+			switch s {
+			case StateConnecting:
+				atomic.AddInt32(&attempts, 1)
+			case StateClosed:
+				closed <- err
+			}
+		},
+	}
+	c := DialReconnecting(context.Background(), "tcp", addr, config, WithServerKey(NewKeyPair().pub))
+	defer c.Close()
+
+	select {
+	case err := <-closed:
+		if err != ErrUnexpectedKey {
+			t.Errorf("Got %v, want %v", err, ErrUnexpectedKey)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Want the client to give up on the wrong server")
+	}
+	if _, err := c.Write([]byte("hello")); err != ErrUnexpectedKey {
+		t.Errorf("Got %v, want %v", err, ErrUnexpectedKey)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("Got %d attempts, want 1", n)
+	}
+}
+
+func TestDialServerKey(t *testing.T) {
+	kp := NewKeyPair()
+	addr, closer := newTestServer(t, NewServer(kp))
+	defer closer()
+
+	conn, err := Dial(addr, WithServerKey(kp.pub))
+	if err != nil {
+		t.Fatalf("Got error %s, want pinned key to match", err)
+	}
+	conn.Close()
+
+	other := NewKeyPair()
+	if _, err := Dial(addr, WithServerKey(other.pub)); err != ErrUnexpectedKey {
+		t.Errorf("Got error %v, want %v", err, ErrUnexpectedKey)
+	}
+}
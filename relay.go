@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// A relay connects two clients that can't reach each other directly, such as
+// when both are behind NAT. Each client opens a session with the relay and
+// sends a relayRequest naming the public key of the peer it wants. Once both
+// have asked for each other, the relay replies to both and copies data
+// between their sessions. The clients then perform a key exchange with each
+// other over the relayed connection, so everything after that is encrypted
+// end to end and the relay only sees ciphertext.
+
+// ErrNoRelayPeer is returned when the peer doesn't connect to the relay in
+// time.
+var ErrNoRelayPeer = errors.New("peer did not connect to the relay")
+
+type relayRequest struct {
+	Peer string `json:"peer"`
+}
+
+type relayReply struct {
+	Error string `json:"error,omitempty"`
+}
+
+type relayKey struct {
+	from, to [keySize]byte
+}
+
+type relayWaiter struct {
+	conn    *Conn
+	matched chan struct{}
+	done    chan struct{}
+}
+
+// Relay is a Handler that pairs up clients asking for each other.
+type Relay struct {
+	// Timeout limits how long a client waits for its peer. Zero means 1
+	// minute.
+	Timeout time.Duration
+
+	// Logger, if set, receives a message for each pairing.
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	waiting map[relayKey]*relayWaiter
+}
+
+// ServeSession implements Handler.
+func (r *Relay) ServeSession(c *Conn) error {
+	var req relayRequest
+	if err := readHeader(c, &req); err != nil {
+		return err
+	}
+	peer, err := ParseKey(req.Peer)
+	if err != nil {
+		writeHeader(c, relayReply{Error: err.Error()})
+		return err
+	}
+	key := relayKey{from: c.Session().Peer, to: *peer}
+	log := orDiscard(r.Logger).With("from", Fingerprint(&key.from), "to", Fingerprint(&key.to))
+
+	r.mu.Lock()
+	if r.waiting == nil {
+		r.waiting = make(map[relayKey]*relayWaiter)
+	}
+	if w, ok := r.waiting[relayKey{from: key.to, to: key.from}]; ok {
+		// The peer is waiting for us.
+		delete(r.waiting, relayKey{from: key.to, to: key.from})
+		r.mu.Unlock()
+		close(w.matched)
+		defer close(w.done)
+		log.Info("relaying")
+		if err := writeHeader(w.conn, relayReply{}); err != nil {
+			return err
+		}
+		if err := writeHeader(c, relayReply{}); err != nil {
+			return err
+		}
+		splice(c, w.conn)
+		return nil
+	}
+	if _, ok := r.waiting[key]; ok {
+		r.mu.Unlock()
+		err := errors.New("already waiting for this peer")
+		writeHeader(c, relayReply{Error: err.Error()})
+		return err
+	}
+	w := &relayWaiter{conn: c, matched: make(chan struct{}), done: make(chan struct{})}
+	r.waiting[key] = w
+	r.mu.Unlock()
+	log.Debug("waiting for peer")
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-w.matched:
+	case <-t.C:
+		r.mu.Lock()
+		if r.waiting[key] == w {
+			delete(r.waiting, key)
+			r.mu.Unlock()
+			writeHeader(c, relayReply{Error: ErrNoRelayPeer.Error()})
+			return ErrNoRelayPeer
+		}
+		r.mu.Unlock()
+	}
+	// The peer's session does the copying.
+	<-w.done
+	return nil
+}
+
+// DialRelay connects to peer through the relay at addr. The options must
+// include WithKeyPair, since the peer needs to know who to ask for. It waits
+// until the peer also connects, then performs a key exchange with it and
+// returns a connection encrypted end to end.
+func DialRelay(ctx context.Context, network, addr string, peer *[keySize]byte, opts ...DialOption) (io.ReadWriteCloser, error) {
+	var cfg dialConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.keyPair == nil {
+		return nil, errors.New("relay needs a key pair that the peer knows")
+	}
+	conn, err := DialContext(ctx, network, addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Give up waiting if the context is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	// Conn splits the peer's messages to fit within the relay's.
+	c := newConn(conn, conn, conn, Session{})
+	kp, err := relayHandshake(c, cfg.keyPair, peer)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	client := NewClient(cfg.keyPair)
+	client.Logger = cfg.logger
+	client.commonKey = kp.CommonKey()
+	client.serverKey = kp.pub
+	return client.SecureConn(c), nil
+}
+
+// relayHandshake asks the relay for peer, then exchanges keys with it.
+func relayHandshake(c *Conn, kp *KeyPair, peer *[keySize]byte) (*KeyPair, error) {
+	if err := writeHeader(c, relayRequest{Peer: hex.EncodeToString(peer[:])}); err != nil {
+		return nil, err
+	}
+	var reply relayReply
+	if err := readHeader(c, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("relay: %s", reply.Error)
+	}
+	got, err := kp.Exchange(c)
+	if err != nil {
+		return nil, err
+	}
+	if *got.pub != *peer {
+		return nil, ErrUnexpectedKey
+	}
+	return got, nil
+}
+
+// relayCommand runs the relay command with args.
+func relayCommand(args []string, logger *slog.Logger) error {
+	fs := newFlagSet("relay", "-key file -peer hex [flags] <[host:]port>")
+	dialOpts := clientFlags(fs)
+	peerKey := fs.String("peer", "", "Hex encoded public key of the peer to connect to")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *peerKey == "" {
+		return usageError(fs, "relay needs a peer and a relay server")
+	}
+	peer, err := ParseKey(*peerKey)
+	if err != nil {
+		return err
+	}
+	opts, err := dialOpts()
+	if err != nil {
+		return err
+	}
+	conn, err := DialRelay(context.Background(), "tcp", hostPort(fs.Arg(0), "localhost"), peer, append(opts, WithLogger(logger))...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return pipe(conn, os.Stdin, os.Stdout)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+type relayResult struct {
+	conn io.ReadWriteCloser
+	err  error
+}
+
+func dialRelay(addr string, kp *KeyPair, peer *[keySize]byte) chan relayResult {
+	ch := make(chan relayResult, 1)
+	go func() {
+		conn, err := DialRelay(context.Background(), "tcp", addr, peer, WithKeyPair(kp))
+		ch <- relayResult{conn, err}
+	}()
+	return ch
+}
+
+func Test_DialRelay(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = &Relay{}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	alice, bob := NewKeyPair(), NewKeyPair()
+	ac, bc := dialRelay(addr, alice, bob.pub), dialRelay(addr, bob, alice.pub)
+	a, b := <-ac, <-bc
+	if a.err != nil {
+		t.Fatal(a.err)
+	}
+	defer a.conn.Close()
+	if b.err != nil {
+		t.Fatal(b.err)
+	}
+	defer b.conn.Close()
+
+	// Once encrypted, this is larger than one relay message, to check that
+	// it's split and rejoined.
+	msg := bytes.Repeat([]byte("b"), int(maxMessageSize))
+	go a.conn.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(b.conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("Got a different message")
+	}
+
+	if _, err := io.WriteString(b.conn, "hi alice"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := a.conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "hi alice" {
+		t.Errorf("Got %q, want %q", got, "hi alice")
+	}
+}
+
+func Test_DialRelay_timeout(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = &Relay{Timeout: 50 * time.Millisecond}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	// Bob asks for someone other than alice, so they never pair.
+	alice, bob := NewKeyPair(), NewKeyPair()
+	ac, bc := dialRelay(addr, alice, bob.pub), dialRelay(addr, bob, NewKeyPair().pub)
+	for _, ch := range []chan relayResult{ac, bc} {
+		res := <-ch
+		if res.err == nil {
+			res.conn.Close()
+			t.Fatal("Expected an error")
+		}
+		if !strings.Contains(res.err.Error(), ErrNoRelayPeer.Error()) {
+			t.Errorf("Got %v, want %v", res.err, ErrNoRelayPeer)
+		}
+	}
+}
+
+func Test_DialRelay_cancel(t *testing.T) {
+	s := NewServer(NewKeyPair())
+	s.Handler = &Relay{}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := DialRelay(ctx, "tcp", addr, NewKeyPair().pub, WithKeyPair(NewKeyPair()))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func Test_DialRelay_noKeyPair(t *testing.T) {
+	if _, err := DialRelay(context.Background(), "tcp", "127.0.0.1:1", NewKeyPair().pub); err == nil {
+		t.Error("Expected an error")
+	}
+}
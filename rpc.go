@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The RPC protocol is a stream of JSON values over a secure connection. The
+// client sends requests, each with an ID unique among its calls in flight,
+// and the server sends a response with the same ID when the method returns.
+// Requests are served concurrently, so responses may arrive in any order.
+
+// ErrRPCClosed is returned by calls on an RPCClient whose connection is
+// closed.
+var ErrRPCClosed = errors.New("rpc client closed")
+
+// RPCError is an error returned by a remote method.
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+type rpcRequest struct {
+	ID     uint64          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// RPCFunc implements a method. It's given the caller's session and the JSON
+// encoded params, and returns a result to be JSON encoded for the caller.
+type RPCFunc func(sess Session, params json.RawMessage) (interface{}, error)
+
+// RPCServer is a Handler that serves named methods.
+type RPCServer struct {
+	mu      sync.RWMutex
+	methods map[string]RPCFunc
+}
+
+// NewRPCServer returns an RPCServer with no methods.
+func NewRPCServer() *RPCServer {
+	return &RPCServer{methods: make(map[string]RPCFunc)}
+}
+
+// Register makes fn callable as method.
+func (s *RPCServer) Register(method string, fn RPCFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[method] = fn
+}
+
+func (s *RPCServer) lookup(method string) RPCFunc {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.methods[method]
+}
+
+// ServeSession implements Handler. It serves requests until the client hangs
+// up, then waits for calls in flight to finish.
+func (s *RPCServer) ServeSession(c *Conn) error {
+	var (
+		wg  sync.WaitGroup
+		wmu sync.Mutex
+	)
+	enc := json.NewEncoder(c)
+	dec := json.NewDecoder(c)
+	defer wg.Wait()
+	for {
+		var req rpcRequest
+		if err := dec.Decode(&req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := s.call(c.Session(), &req)
+			wmu.Lock()
+			defer wmu.Unlock()
+			enc.Encode(res)
+		}()
+	}
+}
+
+func (s *RPCServer) call(sess Session, req *rpcRequest) *rpcResponse {
+	res := &rpcResponse{ID: req.ID}
+	fn := s.lookup(req.Method)
+	if fn == nil {
+		res.Error = fmt.Sprintf("unknown method %q", req.Method)
+		return res
+	}
+	result, err := fn(sess, req.Params)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if res.Result, err = json.Marshal(result); err != nil {
+		res.Result = nil
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// RPCClient calls methods on an RPCServer. It's safe for concurrent use.
+type RPCClient struct {
+	conn io.ReadWriteCloser
+	enc  *json.Encoder
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *rpcResponse
+	err     error
+}
+
+// NewRPCClient returns an RPCClient that makes calls over conn, which is
+// usually a connection returned by Dial.
+func NewRPCClient(conn io.ReadWriteCloser) *RPCClient {
+	c := &RPCClient{
+		conn:    conn,
+		pending: make(map[uint64]chan *rpcResponse),
+	}
+	// Conn takes care of splitting and joining messages, so any size of
+	// request and response can be sent.
+	sc := newConn(conn, conn, conn, Session{})
+	c.enc = json.NewEncoder(sc)
+	go c.readLoop(json.NewDecoder(sc))
+	return c
+}
+
+// DialRPC connects to a server whose Handler is an RPCServer.
+func DialRPC(ctx context.Context, network, addr string, opts ...DialOption) (*RPCClient, error) {
+	conn, err := DialContext(ctx, network, addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewRPCClient(conn), nil
+}
+
+// Call calls method with params and decodes the result into result, which
+// may be nil to discard it. Params are JSON encoded, and may be nil. If the
+// method fails, the error is an *RPCError.
+func (c *RPCClient) Call(ctx context.Context, method string, params, result interface{}) error {
+	req := rpcRequest{Method: method}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = b
+	}
+
+	ch := make(chan *rpcResponse, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.nextID++
+	req.ID = c.nextID
+	c.pending[req.ID] = ch
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	err := c.enc.Encode(&req)
+	c.wmu.Unlock()
+	if err != nil {
+		c.forget(req.ID)
+		return err
+	}
+
+	select {
+	case res := <-ch:
+		if res == nil {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.err
+		}
+		if res.Error != "" {
+			return &RPCError{res.Error}
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(res.Result, result)
+	case <-ctx.Done():
+		c.forget(req.ID)
+		return ctx.Err()
+	}
+}
+
+// Close closes the connection. Calls in flight return ErrRPCClosed.
+func (c *RPCClient) Close() error {
+	c.fail(ErrRPCClosed)
+	return c.conn.Close()
+}
+
+func (c *RPCClient) forget(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *RPCClient) readLoop(dec *json.Decoder) {
+	for {
+		var res rpcResponse
+		if err := dec.Decode(&res); err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		ch := c.pending[res.ID]
+		delete(c.pending, res.ID)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- &res
+		}
+	}
+}
+
+// fail stops the client, failing calls in flight with err.
+func (c *RPCClient) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	if err == io.EOF {
+		err = ErrRPCClosed
+	}
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_RPC_Call(t *testing.T) {
+	rpc := NewRPCServer()
+	rpc.Register("upper", func(sess Session, params json.RawMessage) (interface{}, error) {
+		var s string
+		if err := json.Unmarshal(params, &s); err != nil {
+			return nil, err
+		}
+		return strings.ToUpper(s), nil
+	})
+	rpc.Register("fail", func(sess Session, params json.RawMessage) (interface{}, error) {
+		return nil, errors.New("it failed")
+	})
+	s := NewServer(NewKeyPair())
+	s.Handler = rpc
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	c, err := DialRPC(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var got string
+	if err := c.Call(context.Background(), "upper", "hello", &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != "HELLO" {
+		t.Errorf("Got %q, want HELLO", got)
+	}
+
+	// Arguments larger than a single message.
+	big := strings.Repeat("x", int(maxMessageSize)*2)
+	if err := c.Call(context.Background(), "upper", big, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != strings.ToUpper(big) {
+		t.Errorf("Got %d bytes, want %d", len(got), len(big))
+	}
+
+	err = c.Call(context.Background(), "fail", nil, nil)
+	if e, ok := err.(*RPCError); !ok || e.Message != "it failed" {
+		t.Errorf("Got %v, want RPCError", err)
+	}
+	err = c.Call(context.Background(), "missing", nil, nil)
+	if _, ok := err.(*RPCError); !ok {
+		t.Errorf("Got %v, want RPCError", err)
+	}
+}
+
+func Test_RPC_concurrentCalls(t *testing.T) {
+	release := make(chan struct{})
+	rpc := NewRPCServer()
+	rpc.Register("wait", func(sess Session, params json.RawMessage) (interface{}, error) {
+		<-release
+		return params, nil
+	})
+	rpc.Register("now", func(sess Session, params json.RawMessage) (interface{}, error) {
+		return "now", nil
+	})
+	s := NewServer(NewKeyPair())
+	s.Handler = rpc
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	c, err := DialRPC(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var got int
+			if err := c.Call(context.Background(), "wait", i, &got); err != nil {
+				t.Error(err)
+			}
+			if got != i {
+				t.Errorf("Got %d, want %d", got, i)
+			}
+		}(i)
+	}
+
+	// A quick call isn't held up by slow ones.
+	if err := c.Call(context.Background(), "now", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	wg.Wait()
+}
+
+func Test_RPC_cancel(t *testing.T) {
+	rpc := NewRPCServer()
+	rpc.Register("block", func(sess Session, params json.RawMessage) (interface{}, error) {
+		time.Sleep(time.Second)
+		return nil, nil
+	})
+	s := NewServer(NewKeyPair())
+	s.Handler = rpc
+	addr, closer := newTestServer(t, s)
+	defer closer()
+
+	c, err := DialRPC(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.Call(ctx, "block", nil, nil); err != context.DeadlineExceeded {
+		t.Errorf("Got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- c.Call(context.Background(), "block", nil, nil)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	if err := <-done; err != ErrRPCClosed {
+		t.Errorf("Got %v, want %v", err, ErrRPCClosed)
+	}
+}
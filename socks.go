@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 constants from RFC 1928.
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+	socksConnect      = 0x01
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded          = 0x00
+	socksGeneralFailure     = 0x01
+	socksCommandUnsupported = 0x07
+	socksAddressUnsupported = 0x08
+)
+
+var errSOCKSVersion = errors.New("not a SOCKS5 client")
+
+// SOCKSProxy is a SOCKS5 proxy that makes its outbound connections with
+// Dial, such as through a Tunnel so that they leave from the server. Only
+// the CONNECT command is supported, without authentication, so the proxy
+// should listen on a loopback address.
+type SOCKSProxy struct {
+	// Dial connects to addr, a host:port.
+	Dial func(addr string) (io.ReadWriteCloser, error)
+
+	// Logger, if set, receives diagnostics about proxied connections.
+	Logger *slog.Logger
+}
+
+// Serve accepts clients on l until it's closed.
+func (p *SOCKSProxy) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.serveConn(conn)
+	}
+}
+
+func (p *SOCKSProxy) serveConn(conn net.Conn) {
+	log := orDiscard(p.Logger).With("remote", conn.RemoteAddr())
+	addr, err := socksHandshake(conn)
+	if err != nil {
+		log.Info("socks request failed", "err", err)
+		conn.Close()
+		return
+	}
+	target, err := p.Dial(addr)
+	if err != nil {
+		log.Info("socks connect failed", "addr", addr, "err", err)
+		socksReply(conn, socksGeneralFailure)
+		conn.Close()
+		return
+	}
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		target.Close()
+		conn.Close()
+		return
+	}
+	log.Debug("socks connected", "addr", addr)
+	splice(target, conn)
+}
+
+// socksHandshake negotiates with a SOCKS5 client and reads its request,
+// returning the address to connect to. Unsupported requests are answered
+// with an error.
+func socksHandshake(rw io.ReadWriter) (string, error) {
+	// Method selection: version, count, methods.
+	var hdr [2]byte
+	if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", errSOCKSVersion
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := rw.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoAcceptable {
+		return "", errors.New("client requires authentication")
+	}
+
+	// Request: version, command, reserved, address type, address, port.
+	var req [4]byte
+	if _, err := io.ReadFull(rw, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != socksVersion {
+		return "", errSOCKSVersion
+	}
+	var host string
+	switch req[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, 4)
+		if req[3] == socksIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(rw, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(rw, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(rw, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		socksReply(rw, socksAddressUnsupported)
+		return "", fmt.Errorf("unsupported address type %d", req[3])
+	}
+	var port uint16
+	if err := binary.Read(rw, binary.BigEndian, &port); err != nil {
+		return "", err
+	}
+	if req[1] != socksConnect {
+		socksReply(rw, socksCommandUnsupported)
+		return "", fmt.Errorf("unsupported command %d", req[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// socksReply sends a reply to a request. The bound address isn't known, so
+// it's always zero.
+func socksReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksCommand runs the socks command with args.
+func socksCommand(args []string, logger *slog.Logger) error {
+	fs := newFlagSet("socks", "[flags] <[host:]port>")
+	listenAddr := fs.String("listen", "localhost:1080", "Address for the SOCKS5 proxy")
+	dialOpts := clientFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "socks needs a server")
+	}
+
+	opts, err := dialOpts()
+	if err != nil {
+		return err
+	}
+	opts = append(opts, WithLogger(logger))
+
+	m, err := DialMux(context.Background(), "tcp", hostPort(fs.Arg(0), "localhost"), opts...)
+	if err != nil {
+		return err
+	}
+	t := NewTunnel(m)
+	defer t.Close()
+
+	l, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	go func() {
+		<-m.Done()
+		l.Close()
+	}()
+	logger.Info("socks proxy listening", "addr", l.Addr())
+
+	p := &SOCKSProxy{
+		Dial: func(addr string) (io.ReadWriteCloser, error) {
+			return t.Dial(addr)
+		},
+		Logger: logger,
+	}
+	p.Serve(l)
+	return errors.New("session with server ended")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// newSOCKSProxy starts a SOCKS proxy that dials through tun.
+func newSOCKSProxy(t *testing.T, tun *Tunnel) (addr string, closer func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &SOCKSProxy{Dial: func(addr string) (io.ReadWriteCloser, error) {
+		return tun.Dial(addr)
+	}}
+	go p.Serve(l)
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// socksDial asks the proxy to connect to addr by name, returning the
+// reply code.
+func socksDial(t *testing.T, conn net.Conn, addr string) byte {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	req := []byte{5, 1, 0, 5, 1, 0, socksDomain, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(p))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != 5 || reply[1] != socksNoAuth {
+		t.Fatalf("Got method selection %v", reply[:2])
+	}
+	return reply[3]
+}
+
+func Test_SOCKSProxy(t *testing.T) {
+	target, closeTarget := newEchoTarget(t)
+	defer closeTarget()
+	client := NewKeyPair()
+	s := NewServer(NewKeyPair())
+	s.OnHandshake = AuthorizedKeys{*client.pub: true}.Check
+	s.Handler = &Forwarder{Authorize: s.OnHandshake}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	tun := dialTunnel(t, addr, WithKeyPair(client))
+	defer tun.Close()
+	proxy, closeProxy := newSOCKSProxy(t, tun)
+	defer closeProxy()
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if code := socksDial(t, conn, target); code != socksSucceeded {
+		t.Fatalf("Got reply %d, want success", code)
+	}
+	echoConn(t, conn, "hello via socks")
+}
+
+func Test_SOCKSProxy_unauthorized(t *testing.T) {
+	target, closeTarget := newEchoTarget(t)
+	defer closeTarget()
+	client, authorized := NewKeyPair(), NewKeyPair()
+	s := NewServer(NewKeyPair())
+	s.OnHandshake = AuthorizedKeys{*authorized.pub: true}.Check
+	s.Handler = &Forwarder{Authorize: s.OnHandshake}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	tun := dialTunnel(t, addr, WithKeyPair(client))
+	defer tun.Close()
+	proxy, closeProxy := newSOCKSProxy(t, tun)
+	defer closeProxy()
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if code := socksDial(t, conn, target); code != socksGeneralFailure {
+		t.Errorf("Got reply %d, want failure", code)
+	}
+}
+
+func Test_socksHandshake(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		in    []byte
+		addr  string
+		reply []byte
+	}{
+		{
+			name:  "ipv4",
+			in:    []byte{5, 1, 0, 5, 1, 0, socksIPv4, 127, 0, 0, 1, 0, 80},
+			addr:  "127.0.0.1:80",
+			reply: []byte{5, 0},
+		},
+		{
+			name:  "ipv6",
+			in:    append(append([]byte{5, 1, 0, 5, 1, 0, socksIPv6}, net.IPv6loopback...), 1, 0),
+			addr:  "[::1]:256",
+			reply: []byte{5, 0},
+		},
+		{
+			name:  "auth required",
+			in:    []byte{5, 1, 2},
+			reply: []byte{5, socksNoAcceptable},
+		},
+		{
+			name:  "bind",
+			in:    []byte{5, 1, 0, 5, 2, 0, socksIPv4, 127, 0, 0, 1, 0, 80},
+			reply: []byte{5, 0, 5, socksCommandUnsupported, 0, socksIPv4, 0, 0, 0, 0, 0, 0},
+		},
+	} {
+		var out bytes.Buffer
+		rw := struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewReader(tt.in), &out}
+		addr, err := socksHandshake(rw)
+		if addr != tt.addr {
+			t.Errorf("%s: got %q, want %q", tt.name, addr, tt.addr)
+		}
+		if (err == nil) != (tt.addr != "") {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+		if !bytes.Equal(out.Bytes(), tt.reply) {
+			t.Errorf("%s: got reply %v, want %v", tt.name, out.Bytes(), tt.reply)
+		}
+	}
+}
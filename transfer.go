@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A file transfer is a conversation on a connection:
+//
+//	sender:   fileHeader
+//	receiver: fileReply with the offset to start from
+//	sender:   the file's contents from that offset
+//	receiver: fileReply saying whether the file was stored
+//
+// The receiver keeps a partial download in name.part, so that sending the
+// same file again resumes where the last attempt stopped. The file is only
+// renamed into place once its SHA-256 matches the header. Only one transfer
+// of a name may be in progress at a time.
+
+const partialSuffix = ".part"
+
+type fileHeader struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Mode   uint32 `json:"mode"`
+	SHA256 string `json:"sha256"`
+}
+
+type fileReply struct {
+	Offset int64  `json:"offset,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// SendFile sends the file at path over conn, which is usually a connection
+// from Dial to a server whose Handler is a FileReceiver.
+func SendFile(conn io.ReadWriter, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	sum, err := hashFile(f)
+	if err != nil {
+		return err
+	}
+
+	// Conn splits the contents into messages.
+	c := newConn(conn, conn, nil, Session{})
+	hdr := fileHeader{
+		Name:   filepath.Base(path),
+		Size:   fi.Size(),
+		Mode:   uint32(fi.Mode().Perm()),
+		SHA256: sum,
+	}
+	if err := writeHeader(c, hdr); err != nil {
+		return err
+	}
+	var reply fileReply
+	if err := readFileReply(c, &reply); err != nil {
+		return err
+	}
+	if reply.Offset < 0 || reply.Offset > hdr.Size {
+		return fmt.Errorf("receiver asked for invalid offset %d", reply.Offset)
+	}
+	if _, err := f.Seek(reply.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyBuffer(c, io.LimitReader(f, hdr.Size-reply.Offset), make([]byte, maxMessageSize)); err != nil {
+		return err
+	}
+	return readFileReply(c, &reply)
+}
+
+func readFileReply(r io.Reader, reply *fileReply) error {
+	if err := readHeader(r, reply); err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("receiver: %s", reply.Error)
+	}
+	return nil
+}
+
+// hashFile returns the hex encoded SHA-256 of the rest of f.
+func hashFile(f io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FileReceiver is a Handler that stores files sent with SendFile in Dir.
+// Existing files are never overwritten, and a file that's already being
+// received is refused.
+type FileReceiver struct {
+	Dir string
+
+	// Logger, if set, receives a message for each file.
+	Logger *slog.Logger
+
+	mu        sync.Mutex
+	receiving map[string]bool
+}
+
+// ServeSession implements Handler.
+func (fr *FileReceiver) ServeSession(c *Conn) error {
+	var hdr fileHeader
+	if err := readHeader(c, &hdr); err != nil {
+		return err
+	}
+	log := orDiscard(fr.Logger).With("session", c.Session().ID, "name", hdr.Name, "size", hdr.Size)
+	err := fr.receive(c, &hdr, log)
+	if err != nil {
+		log.Warn("file not received", "err", err)
+		writeHeader(c, fileReply{Error: err.Error()})
+		return err
+	}
+	log.Info("file received")
+	return writeHeader(c, fileReply{})
+}
+
+func (fr *FileReceiver) receive(c *Conn, hdr *fileHeader, log *slog.Logger) error {
+	name := filepath.Base(hdr.Name)
+	if name != hdr.Name || name == "." || name == ".." || name == string(filepath.Separator) {
+		return fmt.Errorf("invalid file name %q", hdr.Name)
+	}
+	if hdr.Size < 0 {
+		return fmt.Errorf("invalid size %d", hdr.Size)
+	}
+	if !fr.start(name) {
+		return fmt.Errorf("%s is already being received", name)
+	}
+	defer fr.finish(name)
+	path := filepath.Join(fr.Dir, name)
+	if _, err := os.Lstat(path); err == nil {
+		return fmt.Errorf("%s already exists", name)
+	}
+
+	// Resume from what's already been received, if anything.
+	partial := path + partialSuffix
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := fi.Size()
+	if offset > hdr.Size {
+		// It's from some other file; start again.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		offset = 0
+	}
+	if offset > 0 {
+		log.Info("resuming", "offset", offset)
+	}
+	if err := writeHeader(c, fileReply{Offset: offset}); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, c, hdr.Size-offset); err != nil {
+		return err
+	}
+
+	// Check the whole file, including any earlier part.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	sum, err := hashFile(f)
+	if err != nil {
+		return err
+	}
+	if sum != hdr.SHA256 {
+		os.Remove(partial)
+		return errors.New("checksum mismatch")
+	}
+	if err := f.Chmod(os.FileMode(hdr.Mode).Perm()); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, path)
+}
+
+// start claims name for a transfer, returning false if another transfer of it
+// is in progress.
+func (fr *FileReceiver) start(name string) bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.receiving[name] {
+		return false
+	}
+	if fr.receiving == nil {
+		fr.receiving = make(map[string]bool)
+	}
+	fr.receiving[name] = true
+	return true
+}
+
+// finish releases name once its transfer is over.
+func (fr *FileReceiver) finish(name string) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	delete(fr.receiving, name)
+}
+
+// sendCommand runs the send command with args.
+func sendCommand(args []string, logger *slog.Logger) error {
+	fs := newFlagSet("send", "[flags] <file> <[host:]port>")
+	dialOpts := clientFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return usageError(fs, "send needs a file and a server")
+	}
+	opts, err := dialOpts()
+	if err != nil {
+		return err
+	}
+	conn, err := DialContext(context.Background(), "tcp", hostPort(fs.Arg(1), "localhost"), append(opts, WithLogger(logger))...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return SendFile(conn, fs.Arg(0))
+}
+
+// receiveCommand runs the receive command with args.
+func receiveCommand(args []string, logger *slog.Logger) error {
+	fs := newFlagSet("receive", "[flags] <dir>")
+	addr := fs.String("listen", ":7700", "Address to receive files on")
+	loadConfig := serverFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "receive needs a directory")
+	}
+	if fi, err := os.Stat(fs.Arg(0)); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", fs.Arg(0))
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	listen := *addr
+	if cfg.Listen != "" {
+		listen = cfg.Listen
+	}
+	overrideFlags(fs, map[string]func(){"listen": func() { listen = *addr }})
+	s, err := cfg.NewServer(logger)
+	if err != nil {
+		return err
+	}
+	s.Handler = &FileReceiver{Dir: fs.Arg(0), Logger: logger}
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	logger.Info("receiving files", "addr", l.Addr(), "dir", fs.Arg(0), "key", hex.EncodeToString(s.keyPair.pub[:]))
+	return s.Serve(l)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSendFile writes a file of random data to send.
+func newSendFile(t *testing.T, size int, mode os.FileMode) (path string, data []byte) {
+	dir, err := ioutil.TempDir("", "send")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = make([]byte, size)
+	rand.Read(data)
+	path = filepath.Join(dir, "data.bin")
+	if err := ioutil.WriteFile(path, data, mode); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func sendFile(t *testing.T, addr, path string) error {
+	conn, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return SendFile(conn, path)
+}
+
+func Test_SendFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewServer(NewKeyPair())
+	s.Handler = &FileReceiver{Dir: dir}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	path, data := newSendFile(t, 100*1000, 0640)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if err := sendFile(t, addr, path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Got %d bytes, want the %d sent", len(got), len(data))
+	}
+	fi, _ := os.Stat(filepath.Join(dir, "data.bin"))
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("Got mode %s, want -rw-r-----", fi.Mode())
+	}
+
+	// The file isn't overwritten.
+	if err := sendFile(t, addr, path); err == nil || !strings.Contains(err.Error(), "exists") {
+		t.Errorf("Got %v, want an error that the file exists", err)
+	}
+}
+
+func Test_SendFile_resume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewServer(NewKeyPair())
+	s.Handler = &FileReceiver{Dir: dir}
+	received := make(chan uint64, 10)
+	s.OnSessionEnd = func(stats SessionStats, err error) {
+		received <- stats.BytesIn
+	}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	path, data := newSendFile(t, 100*1000, 0600)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	// An earlier attempt got part way.
+	partial := filepath.Join(dir, "data.bin"+partialSuffix)
+	if err := ioutil.WriteFile(partial, data[:60*1000], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendFile(t, addr, path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Got %d bytes, want the %d sent", len(got), len(data))
+	}
+	if n := <-received; n >= 50*1000 {
+		t.Errorf("Got %d bytes, want only the rest of the file", n)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("Want the partial file to be gone, got %v", err)
+	}
+}
+
+func Test_SendFile_corruptPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewServer(NewKeyPair())
+	s.Handler = &FileReceiver{Dir: dir}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	path, data := newSendFile(t, 1000, 0600)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	// A partial file that doesn't match is detected at the end, and the
+	// next attempt starts over.
+	partial := filepath.Join(dir, "data.bin"+partialSuffix)
+	if err := ioutil.WriteFile(partial, make([]byte, 500), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendFile(t, addr, path); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("Got %v, want a checksum error", err)
+	}
+	if err := sendFile(t, addr, path); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadFile(filepath.Join(dir, "data.bin"))
+	if !bytes.Equal(got, data) {
+		t.Errorf("Got %d bytes, want the %d sent", len(got), len(data))
+	}
+}
+
+func Test_SendFile_concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewServer(NewKeyPair())
+	s.Handler = &FileReceiver{Dir: dir}
+	addr, closer := newTestServer(t, s)
+	defer closer()
+	path, data := newSendFile(t, 1000, 0600)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	// The first sender sends part of the file and stalls.
+	conn, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newConn(conn, conn, nil, Session{})
+	sum, err := hashFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeHeader(c, fileHeader{Name: "data.bin", Size: int64(len(data)), Mode: 0600, SHA256: sum}); err != nil {
+		t.Fatal(err)
+	}
+	var reply fileReply
+	if err := readFileReply(c, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(data[:400]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendFile(t, addr, path); err == nil || !strings.Contains(err.Error(), "already being received") {
+		t.Errorf("Got %v, want the second transfer refused", err)
+	}
+
+	// The first sender's progress survives for the next attempt to resume.
+	conn.Close()
+	partial := filepath.Join(dir, "data.bin"+partialSuffix)
+	for tries := 0; ; tries++ {
+		err := sendFile(t, addr, path)
+		if err == nil {
+			break
+		}
+		if tries == 100 || !strings.Contains(err.Error(), "already being received") {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	got, _ := ioutil.ReadFile(filepath.Join(dir, "data.bin"))
+	if !bytes.Equal(got, data) {
+		t.Errorf("Got %d bytes, want the %d sent", len(got), len(data))
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("Want the partial file to be gone, got %v", err)
+	}
+}
+
+func Test_FileReceiver_name(t *testing.T) {
+	fr := &FileReceiver{Dir: os.TempDir()}
+	rw := &messageRW{}
+	c := newConn(rw, rw, nil, Session{})
+	for _, name := range []string{"", ".", "..", "../x", "a/b", "/etc/passwd"} {
+		if err := fr.receive(c, &fileHeader{Name: name}, discardLogger); err == nil || !strings.Contains(err.Error(), "invalid file name") {
+			t.Errorf("receive(%q) got %v, want invalid file name", name, err)
+		}
+	}
+}